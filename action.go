@@ -0,0 +1,433 @@
+package dbot
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ActionParam is the schema of a param of an Action. Type can be "string",
+// "bool", "number", "list", "map" or "any" (default). If the param is not
+// set, Default is used. The param named "*" accepts the other params.
+type ActionParam struct {
+	Name     string
+	Type     string
+	Required bool
+	Default  interface{}
+}
+
+// Action is the implementation of a tag
+type Action interface {
+	// Params returns the schema of the params of the command. The params in
+	// the config file are checked and converted by it, and the strings in
+	// them are parsed with the Env.
+	Params() []*ActionParam
+	// Check validates the command when the context is created. If the
+	// command is invalid, the error is logged to ctx and false is returned.
+	Check(ctx *Context) bool
+	// Run runs the command on ctx.Runner()
+	Run(ctx *Context) bool
+}
+
+// funcAction is an Action made of functions
+type funcAction struct {
+	params []*ActionParam
+	check  func(ctx *Context) bool
+	run    func(ctx *Context) bool
+}
+
+// NewAction creates an Action from functions, check can be nil
+func NewAction(
+	params []*ActionParam,
+	check func(ctx *Context) bool,
+	run func(ctx *Context) bool,
+) Action {
+	return &funcAction{params: params, check: check, run: run}
+}
+
+func (p *funcAction) Params() []*ActionParam {
+	return p.params
+}
+
+func (p *funcAction) Check(ctx *Context) bool {
+	if p.check == nil {
+		return true
+	}
+
+	return p.check(ctx)
+}
+
+func (p *funcAction) Run(ctx *Context) bool {
+	return p.run(ctx)
+}
+
+var (
+	gPluginMap  = map[string]bool{}
+	gPluginLock = sync.Mutex{}
+)
+
+// LoadPlugin opens the Go plugin at path. The plugin registers its actions
+// and runners in its init functions, or in the exported function
+// "DbotRegister func() error" if it has one.
+func LoadPlugin(path string) error {
+	gPluginLock.Lock()
+	defer gPluginLock.Unlock()
+
+	// The plugin is registered only once
+	if gPluginMap[path] {
+		return nil
+	}
+
+	p, e := plugin.Open(path)
+	if e != nil {
+		return e
+	}
+
+	symbol, e := p.Lookup("DbotRegister")
+	if e != nil {
+		// DbotRegister is optional
+		gPluginMap[path] = true
+		return nil
+	}
+
+	if fn, ok := symbol.(func() error); ok {
+		if e := fn(); e != nil {
+			return e
+		}
+		gPluginMap[path] = true
+		return nil
+	}
+
+	return fmt.Errorf("DbotRegister in \"%s\" must be func() error", path)
+}
+
+// checkModeTags are the built-in tags that predict their changes in check
+// mode. The other tags run in check mode only if they are check_safe.
+var checkModeTags = map[string]bool{
+	"script":   true,
+	"copy":     true,
+	"template": true,
+	"sync":     true,
+	"fetch":    true,
+}
+
+func init() {
+	_ = RegisterAction("cmd", NewAction(nil, checkCommand, runCommand))
+	_ = RegisterAction("script", NewAction(nil, checkCommand, runScript))
+	_ = RegisterAction("copy", NewAction(nil, checkCopy, runCopy))
+	_ = RegisterAction("template", NewAction(nil, checkFile, runTemplate))
+	_ = RegisterAction("sync", NewAction(nil, checkSync, runSync))
+	_ = RegisterAction("fetch", NewAction(nil, checkFetch, runFetch))
+}
+
+func runCommand(ctx *Context) bool  { return ctx.runCommand() }
+func runScript(ctx *Context) bool   { return ctx.runScript() }
+func runCopy(ctx *Context) bool     { return ctx.runCopy() }
+func runTemplate(ctx *Context) bool { return ctx.runTemplate() }
+func runSync(ctx *Context) bool     { return ctx.runSync() }
+func runFetch(ctx *Context) bool    { return ctx.runFetch() }
+
+func checkCommand(p *Context) bool {
+	rawCmd, runCmd := p.rawCmd, p.runCmd
+
+	if len(rawCmd.Args) > 0 {
+		p.Clone("%s.args", p.path).LogError(
+			"unsupported args on tag \"%s\"", runCmd.Tag,
+		)
+	}
+
+	if rawCmd.File != "" {
+		p.Clone("%s.file", p.path).LogError(
+			"unsupported file on tag \"%s\"", runCmd.Tag,
+		)
+	}
+
+	for idx, v := range runCmd.Filter {
+		if _, e := regexp.Compile(v); e != nil {
+			p.Clone("%s.filter[%d]", p.path, idx).LogError(e.Error())
+			return false
+		}
+	}
+
+	for idx, it := range runCmd.Expect {
+		if _, e := regexp.Compile(it.Pattern); e != nil {
+			p.Clone("%s.expect[%d].pattern", p.path, idx).LogError(e.Error())
+			return false
+		}
+
+		if v, e := time.ParseDuration(it.Timeout); e != nil || v <= 0 {
+			p.Clone("%s.expect[%d].timeout", p.path, idx).LogError(
+				"timeout \"%s\" is invalid", it.Timeout,
+			)
+			return false
+		}
+	}
+
+	if e := checkCondition(runCmd.ChangedWhen); e != nil {
+		p.Clone("%s.changed_when", p.path).LogError(e.Error())
+		return false
+	}
+
+	if e := checkCondition(runCmd.FailedWhen); e != nil {
+		p.Clone("%s.failed_when", p.path).LogError(e.Error())
+		return false
+	}
+
+	if len(SplitCommand(runCmd.Shell)) == 0 {
+		p.Clone("%s.shell", p.path).LogError(
+			"shell \"%s\" is invalid", runCmd.Shell,
+		)
+		return false
+	}
+
+	if width, height := runCmd.TtySize(); width <= 0 || height <= 0 {
+		p.Clone("%s.tty_width", p.path).LogError(
+			"tty size \"%sx%s\" is invalid",
+			runCmd.TtyWidth, runCmd.TtyHeight,
+		)
+		return false
+	}
+
+	return true
+}
+
+// checkSrcDest checks the src and dest of the file tags
+func checkSrcDest(p *Context) bool {
+	if p.runCmd.Src == "" {
+		p.Clone("%s.src", p.path).LogError("src is empty")
+		return false
+	}
+
+	if p.runCmd.Dest == "" {
+		p.Clone("%s.dest", p.path).LogError("dest is empty")
+		return false
+	}
+
+	return true
+}
+
+func checkFile(p *Context) bool {
+	if !checkSrcDest(p) {
+		return false
+	}
+
+	if _, e := p.runCmd.FileMode(0); e != nil {
+		p.Clone("%s.mode", p.path).LogError(e.Error())
+		return false
+	}
+
+	return true
+}
+
+// checkCopy checks the copy tag, it copies either the file src or content
+func checkCopy(p *Context) bool {
+	if p.runCmd.Content == "" {
+		return checkFile(p)
+	}
+
+	if p.runCmd.Src != "" {
+		p.Clone("%s.src", p.path).LogError("src and content are both set")
+		return false
+	}
+
+	if p.runCmd.Dest == "" {
+		p.Clone("%s.dest", p.path).LogError("dest is empty")
+		return false
+	}
+
+	if _, e := p.runCmd.FileMode(0); e != nil {
+		p.Clone("%s.mode", p.path).LogError(e.Error())
+		return false
+	}
+
+	return true
+}
+
+func checkSync(p *Context) bool {
+	if !checkSrcDest(p) {
+		return false
+	}
+
+	if v := p.runCmd.Compare; v != "mtime" && v != "size" && v != "checksum" {
+		p.Clone("%s.compare", p.path).LogError(
+			"unsupported compare \"%s\"", v,
+		)
+		return false
+	}
+
+	for idx, v := range p.runCmd.Exclude {
+		if _, e := filepath.Match(v, ""); e != nil {
+			p.Clone("%s.exclude[%d]", p.path, idx).LogError(e.Error())
+			return false
+		}
+	}
+
+	return true
+}
+
+func checkFetch(p *Context) bool {
+	if p.runCmd.Src == "" {
+		p.Clone("%s.src", p.path).LogError("src is empty")
+		return false
+	}
+
+	if p.runCmd.Dest == "" {
+		p.runCmd.Dest = "out"
+	}
+
+	if p.rawCmd.Mode != "" || p.rawCmd.Owner != "" {
+		p.Clone("%s.mode", p.path).LogError(
+			"unsupported mode and owner on tag \"%s\"", p.runCmd.Tag,
+		)
+	}
+
+	return true
+}
+
+// parseParams checks the params by the schema, and parses the strings in
+// them with env
+func (p *Context) parseParams(
+	schema []*ActionParam, params map[string]interface{}, env Env,
+) (map[string]interface{}, bool) {
+	ret := make(map[string]interface{})
+	known := make(map[string]bool)
+	var others *ActionParam
+
+	for _, it := range schema {
+		if it.Name == "*" {
+			others = it
+			continue
+		}
+
+		known[it.Name] = true
+		value, ok := params[it.Name]
+
+		if !ok || value == nil {
+			if it.Required {
+				p.Clone("%s.%s", p.path, it.Name).
+					LogError("%s is required", it.Name)
+				return nil, false
+			} else if it.Default != nil {
+				ret[it.Name] = it.Default
+			}
+			continue
+		}
+
+		v, e := convertParam(it.Type, parseParamValue(env, value))
+		if e != nil {
+			p.Clone("%s.%s", p.path, it.Name).
+				LogError("%s %s", it.Name, e.Error())
+			return nil, false
+		}
+		ret[it.Name] = v
+	}
+
+	unknown := make([]string, 0)
+	for key := range params {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	if others != nil {
+		for _, key := range unknown {
+			v, e := convertParam(others.Type, parseParamValue(env, params[key]))
+			if e != nil {
+				p.Clone("%s.%s", p.path, key).LogError("%s %s", key, e.Error())
+				return nil, false
+			}
+			ret[key] = v
+		}
+	} else if len(unknown) > 0 {
+		p.Clone("%s.%s", p.path, unknown[0]).
+			LogError("unsupported param \"%s\"", unknown[0])
+		return nil, false
+	}
+
+	return ret, true
+}
+
+// parseParamValue parses the strings in v with env, and converts the yaml
+// maps to map[string]interface{}
+func parseParamValue(env Env, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return env.ParseString(v, "", false)
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, it := range v {
+			ret[i] = parseParamValue(env, it)
+		}
+		return ret
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{})
+		for key, it := range v {
+			ret[fmt.Sprintf("%v", key)] = parseParamValue(env, it)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{})
+		for key, it := range v {
+			ret[key] = parseParamValue(env, it)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// convertParam converts v to the param type. The strings are converted to
+// bool and number, so that they can be set by the Env.
+func convertParam(kind string, v interface{}) (interface{}, error) {
+	switch kind {
+	case "", "any":
+		return v, nil
+	case "string":
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case bool, int, int64, float64:
+			return fmt.Sprintf("%v", v), nil
+		}
+	case "bool":
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if ret, e := strconv.ParseBool(v); e == nil {
+				return ret, nil
+			}
+		}
+	case "number":
+		switch v := v.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if ret, e := strconv.ParseFloat(v, 64); e == nil {
+				return ret, nil
+			}
+		}
+	case "list":
+		if ret, ok := v.([]interface{}); ok {
+			return ret, nil
+		}
+	case "map":
+		if ret, ok := v.(map[string]interface{}); ok {
+			return ret, nil
+		}
+	default:
+		return nil, fmt.Errorf("has unsupported type \"%s\"", kind)
+	}
+
+	return nil, fmt.Errorf("must be %s", kind)
+}
@@ -0,0 +1,113 @@
+package dbot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConvertParam(t *testing.T) {
+	testCases := []struct {
+		kind string
+		v    interface{}
+		want interface{}
+		ok   bool
+	}{
+		{"", "x", "x", true},
+		{"any", 1, 1, true},
+		{"string", "x", "x", true},
+		{"string", 8080, "8080", true},
+		{"string", true, "true", true},
+		{"string", []interface{}{}, nil, false},
+		{"bool", true, true, true},
+		{"bool", "false", false, true},
+		{"bool", "yes", nil, false},
+		{"bool", 1, nil, false},
+		{"number", 3, float64(3), true},
+		{"number", int64(3), float64(3), true},
+		{"number", 1.5, 1.5, true},
+		{"number", "2.5", 2.5, true},
+		{"number", "x", nil, false},
+		{"list", []interface{}{"a"}, []interface{}{"a"}, true},
+		{"list", "a", nil, false},
+		{
+			"map", map[string]interface{}{"a": 1},
+			map[string]interface{}{"a": 1}, true,
+		},
+		{"map", []interface{}{}, nil, false},
+		{"unknown", "x", nil, false},
+	}
+
+	for _, it := range testCases {
+		got, e := convertParam(it.kind, it.v)
+		if (e == nil) != it.ok || !reflect.DeepEqual(got, it.want) {
+			t.Errorf(
+				"convertParam(%q, %v) = %v, %v, want %v",
+				it.kind, it.v, got, e, it.want,
+			)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	ctx := &Context{options: &Options{}, path: "params"}
+	env := Env{"port": "8080", "name": "web"}
+	schema := []*ActionParam{
+		{Name: "name", Type: "string", Required: true},
+		{Name: "port", Type: "number", Default: float64(80)},
+		{Name: "debug", Type: "bool"},
+	}
+
+	testCases := []struct {
+		schema []*ActionParam
+		params map[string]interface{}
+		want   map[string]interface{}
+		ok     bool
+	}{
+		{
+			schema, map[string]interface{}{"name": "${name}"},
+			map[string]interface{}{"name": "web", "port": float64(80)}, true,
+		},
+		{
+			schema, map[string]interface{}{
+				"name": "a", "port": "${port}", "debug": "true",
+			},
+			map[string]interface{}{
+				"name": "a", "port": float64(8080), "debug": true,
+			}, true,
+		},
+		{schema, map[string]interface{}{"port": 1}, nil, false},
+		{schema, map[string]interface{}{"name": nil}, nil, false},
+		{
+			schema, map[string]interface{}{"name": "a", "port": "x"},
+			nil, false,
+		},
+		{
+			schema, map[string]interface{}{"name": "a", "other": 1},
+			nil, false,
+		},
+		{
+			[]*ActionParam{{Name: "*", Type: "string"}},
+			map[string]interface{}{"a": 1, "b": "${name}"},
+			map[string]interface{}{"a": "1", "b": "web"}, true,
+		},
+		{
+			[]*ActionParam{{Name: "list", Type: "list"}},
+			map[string]interface{}{"list": []interface{}{
+				"${port}", map[interface{}]interface{}{"k": "${name}"},
+			}},
+			map[string]interface{}{"list": []interface{}{
+				"8080", map[string]interface{}{"k": "web"},
+			}}, true,
+		},
+	}
+
+	for idx, it := range testCases {
+		got, ok := ctx.parseParams(it.schema, it.params, env)
+		if ok != it.ok || !reflect.DeepEqual(got, it.want) {
+			t.Errorf(
+				"case %d: parseParams() = %v, %v, want %v, %v",
+				idx, got, ok, it.want, it.ok,
+			)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package dbot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunnerCache is the data of a runner that is kept on the disk between the
+// runs, such as the facts and the registered results
+type RunnerCache struct {
+	Name        string    `json:"name"`
+	FactsTime   time.Time `json:"facts_time"`
+	Facts       Env       `json:"facts"`
+	ResultsTime time.Time `json:"results_time"`
+	Results     Env       `json:"results"`
+}
+
+// CacheDir returns the directory of the runner caches, it is "dbot" in the
+// user cache directory, such as ~/.cache/dbot
+func CacheDir() (string, error) {
+	dir, e := os.UserCacheDir()
+	if e != nil {
+		return "", e
+	}
+
+	return filepath.Join(dir, "dbot"), nil
+}
+
+func runnerCacheFile(dir string, name string) string {
+	return filepath.Join(dir, url.PathEscape(name)+".json")
+}
+
+// LoadRunnerCache loads the cache of the runner. It returns nil if the
+// cache does not exist.
+func LoadRunnerCache(name string) (*RunnerCache, error) {
+	dir, e := CacheDir()
+	if e != nil {
+		return nil, e
+	}
+
+	return loadRunnerCacheFile(runnerCacheFile(dir, name))
+}
+
+func loadRunnerCacheFile(file string) (*RunnerCache, error) {
+	data, e := ioutil.ReadFile(file)
+	if os.IsNotExist(e) {
+		return nil, nil
+	} else if e != nil {
+		return nil, e
+	}
+
+	ret := &RunnerCache{}
+	if e := json.Unmarshal(data, ret); e != nil {
+		return nil, e
+	}
+
+	return ret, nil
+}
+
+// SaveRunnerCache saves the cache of the runner
+func SaveRunnerCache(cache *RunnerCache) error {
+	dir, e := CacheDir()
+	if e != nil {
+		return e
+	}
+
+	if e := os.MkdirAll(dir, 0700); e != nil {
+		return e
+	}
+
+	data, e := json.MarshalIndent(cache, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	file := runnerCacheFile(dir, cache.Name)
+	tmpFile := tempFilePath(file)
+	if e := ioutil.WriteFile(tmpFile, data, 0600); e != nil {
+		return e
+	}
+
+	if e := os.Rename(tmpFile, file); e != nil {
+		_ = os.Remove(tmpFile)
+		return e
+	}
+
+	return nil
+}
+
+// FindRunnerCaches returns the caches of the runners that match pattern.
+// pattern can be the runner name, the host of the runner, or a glob
+// pattern of the runner names.
+func FindRunnerCaches(pattern string) ([]*RunnerCache, error) {
+	dir, e := CacheDir()
+	if e != nil {
+		return nil, e
+	}
+
+	files, e := filepath.Glob(filepath.Join(dir, "*.json"))
+	if e != nil {
+		return nil, e
+	}
+	sort.Strings(files)
+
+	ret := make([]*RunnerCache, 0)
+	for _, file := range files {
+		cache, e := loadRunnerCacheFile(file)
+		if e != nil || cache == nil {
+			continue
+		}
+
+		// The host of "user@host:port"
+		host := cache.Name
+		if idx := strings.LastIndex(host, "@"); idx >= 0 {
+			host = host[idx+1:]
+		}
+		if idx := strings.LastIndex(host, ":"); idx >= 0 {
+			host = host[:idx]
+		}
+
+		matched, _ := filepath.Match(pattern, cache.Name)
+		if matched || host == pattern || cache.Facts["hostname"] == pattern {
+			ret = append(ret, cache)
+		}
+	}
+
+	return ret, nil
+}
+
+// loadCache loads the cached facts and results of the runner that are not
+// older than ttl
+func (p *RunnerData) loadCache(name string, ttl time.Duration) {
+	cache, e := LoadRunnerCache(name)
+	if e != nil || cache == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	if len(cache.Facts) > 0 && now.Sub(cache.FactsTime) < ttl {
+		p.facts = cache.Facts
+		p.factsTime = cache.FactsTime
+	}
+
+	if len(cache.Results) > 0 && now.Sub(cache.ResultsTime) < ttl {
+		p.results = cache.Results.Merge(p.results)
+		p.resultsTime = cache.ResultsTime
+	}
+}
+
+// cache returns the cache of the runner, it returns nil if there is nothing
+// to cache
+func (p *RunnerData) cache(name string) *RunnerCache {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.facts) == 0 && len(p.results) == 0 {
+		return nil
+	}
+
+	return &RunnerCache{
+		Name:        name,
+		FactsTime:   p.factsTime,
+		Facts:       p.facts.Merge(nil),
+		ResultsTime: p.resultsTime,
+		Results:     p.results.Merge(nil),
+	}
+}
+
+// saveRunnerCache saves the data of all the runners to the cache
+func (p *Context) saveRunnerCache() {
+	if p.options.CacheTTL <= 0 {
+		return
+	}
+
+	gRunnerDataLock.Lock()
+	defer gRunnerDataLock.Unlock()
+
+	for name, runnerData := range p.runnerDataMap {
+		if cache := runnerData.cache(name); cache != nil {
+			if e := SaveRunnerCache(cache); e != nil {
+				p.LogError("could not save the cache: %s", e.Error())
+			}
+		}
+	}
+}
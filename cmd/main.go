@@ -1,11 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/rpccloud/dbot"
 )
 
+// printFacts prints the cached facts of the runners that match host
+func printFacts(host string) bool {
+	caches, e := dbot.FindRunnerCaches(host)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e.Error())
+		return false
+	} else if len(caches) == 0 {
+		fmt.Fprintf(os.Stderr, "could not find the cache of \"%s\"\n", host)
+		return false
+	}
+
+	data, e := json.MarshalIndent(caches, "", "  ")
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e.Error())
+		return false
+	}
+
+	fmt.Println(string(data))
+	return true
+}
+
 func main() {
 	cfgFile := ""
 	flag.StringVar(
@@ -23,10 +48,90 @@ func main() {
 		"set the name of the job to run",
 	)
 
+	inventory := ""
+	flag.StringVar(
+		&inventory,
+		"inventory",
+		"",
+		"set the inventory file, its groups can be used by all jobs",
+	)
+
+	limit := ""
+	flag.StringVar(
+		&limit,
+		"limit",
+		"",
+		"restrict the runners of all the commands, such as \"web:!web03\"",
+	)
+
+	cacheTTL := time.Duration(0)
+	flag.DurationVar(
+		&cacheTTL,
+		"cache-ttl",
+		0,
+		"set how long the facts and the results are cached on disk, "+
+			"0 disables it",
+	)
+
+	check := false
+	flag.BoolVar(
+		&check,
+		"check",
+		false,
+		"predict the changes without applying them",
+	)
+
+	diff := false
+	flag.BoolVar(
+		&diff,
+		"diff",
+		false,
+		"show the diff of the files changed by copy and template",
+	)
+
+	report := ""
+	flag.StringVar(
+		&report,
+		"report",
+		"",
+		"write the results of the commands to the file as JSON",
+	)
+
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage:\n  %s [flags]\n  %s facts <host>\n\nFlags:\n",
+			os.Args[0], os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
-	ctx := dbot.NewContext(cfgFile, jobName)
-	if ctx != nil {
-		ctx.Run()
+	// Print the cached facts
+	if flag.Arg(0) == "facts" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if !printFacts(flag.Arg(1)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx := dbot.NewContextWithOptions(cfgFile, jobName, &dbot.Options{
+		Inventory: inventory,
+		Limit:     limit,
+		CacheTTL:  cacheTTL,
+		Check:     check,
+		Diff:      diff,
+		Report:    report,
+	})
+	if ctx == nil {
+		os.Exit(1)
+	} else if !ctx.Run() || ctx.HasFailed() {
+		os.Exit(1)
 	}
 }
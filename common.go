@@ -1,7 +1,11 @@
 package dbot
 
 import (
+	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -42,6 +46,17 @@ func (p Env) ParseString(v string, defaultStr string, trimSpace bool) string {
 	return ret
 }
 
+// ParseFirst returns the first value that is not empty after parsing
+func (p Env) ParseFirst(values ...string) string {
+	for _, v := range values {
+		if ret := p.ParseString(v, "", true); ret != "" {
+			return ret
+		}
+	}
+
+	return ""
+}
+
 func (p Env) ParseStringArray(arr []string) []string {
 	ret := make([]string, len(arr))
 
@@ -76,7 +91,14 @@ func (p Env) Merge(env Env) Env {
 	return ret
 }
 
+// Import imports the runners of the group Name. Type can be "remotes"
+// (default) or "inventory", which reads the group from the file File, or
+// "exec" and "script", which run the executable or the JavaScript File and
+// read the inventory from its JSON output. Env is passed to the executable
+// and the script. If Name is empty, all the hosts of the inventory are
+// imported.
 type Import struct {
+	Type string
 	Name string
 	File string
 	Env  Env
@@ -87,29 +109,297 @@ type Input struct {
 	Desc string
 }
 
+// Remote is a runner. Type is the registered runner type (default "ssh"),
+// Config is the extra config passed to the runner factory, and Vars is the
+// variables of the runner, they are merged into the Env of the commands
+// that run on it.
 type Remote struct {
-	Port string
-	User string
-	Host string
+	Type   string
+	Port   string
+	User   string
+	Host   string
+	Config map[string]string
+	Vars   Env
+}
+
+// Container is a docker container. Docker is the path of the docker binary,
+// and User is the user that runs the commands in the container.
+type Container struct {
+	Name   string
+	User   string
+	Docker string
+}
+
+// Pods selects the running kubernetes pods in Namespace (default
+// "default") by the label Selector. Kubectl is the path of the kubectl
+// binary, Context is the kubeconfig context, and Container is the container
+// in the pods.
+type Pods struct {
+	Namespace string
+	Selector  string
+	Container string
+	Context   string
+	Kubectl   string
 }
 
 type Job struct {
-	Async    bool
-	Imports  map[string]*Import
-	Remotes  map[string][]*Remote
-	Inputs   map[string]*Input
-	Env      Env
-	Commands []*Command
+	Async      bool
+	Imports    map[string]*Import
+	Remotes    map[string][]*Remote
+	Containers map[string][]*Container
+	Pods       map[string]*Pods
+	// Plugins is the Go plugins that register the tags and runners
+	Plugins []string
+	// GatherFacts collects the facts of the runners before the commands
+	// run on them, they are available as ${facts.*}
+	GatherFacts bool `yaml:"gather_facts" json:"gather_facts"`
+	Inputs      map[string]*Input
+	Env         Env
+	Commands    []*Command
+	// Handlers are the commands that run at the end of the job, or at the
+	// command with the tag "flush_handlers", on the runners where they are
+	// notified by the changed commands
+	Handlers map[string]*Command
+	// Become, BecomeUser, BecomeMethod and BecomePassword are the default
+	// privilege escalation of the commands in the job
+	Become         bool
+	BecomeUser     string `yaml:"become_user" json:"become_user"`
+	BecomeMethod   string `yaml:"become_method" json:"become_method"`
+	BecomePassword string `yaml:"become_password" json:"become_password"`
+}
+
+// Expect sends Send to the command input after the output matches the
+// regular expression Pattern. If Secret is true, Send will be masked in
+// the log.
+type Expect struct {
+	Pattern string
+	Send    string
+	Timeout string
+	Secret  bool
 }
 
 type Command struct {
-	Tag   string
-	Exec  string
-	On    string
-	Stdin []string
-	Env   Env
-	Args  Env
-	File  string
+	Tag       string
+	Exec      string
+	On        string
+	Stdin     []string
+	Filter    []string
+	Expect    []*Expect
+	Tty       bool
+	TtyTerm   string `yaml:"tty_term" json:"tty_term"`
+	TtyWidth  string `yaml:"tty_width" json:"tty_width"`
+	TtyHeight string `yaml:"tty_height" json:"tty_height"`
+	Src       string
+	Dest      string
+	// Content is written to Dest by the copy tag instead of the file Src
+	Content string
+	Mode    string
+	Owner   string
+	// FailOnMissing fails the fetch tag if the remote file does not exist
+	FailOnMissing bool `yaml:"fail_on_missing" json:"fail_on_missing"`
+	// Register saves the output of the command with this name
+	Register string
+	// Delete removes the extraneous files on the runner in the sync tag
+	Delete bool
+	// Exclude is the glob patterns of the files that the sync tag ignores
+	Exclude []string
+	// Compare is how the sync tag finds the changed files, it can be
+	// "mtime" (size and mtime), "size" or "checksum"
+	Compare string
+	// Shell runs Exec, the default is "/bin/sh -c"
+	Shell string
+	// Cwd is the working directory of Exec
+	Cwd string
+	// Creates skips the command if the path exists on the runner, Removes
+	// skips the command if the path does not exist, and Unless skips the
+	// command if the shell command succeeds on the runner
+	Creates string
+	Removes string
+	Unless  string
+	// ChangedWhen and FailedWhen are the JavaScript conditions that decide
+	// whether the command has changed the runner and whether it has
+	// failed, they can use stdout, stderr and rc (the exit code)
+	ChangedWhen string `yaml:"changed_when" json:"changed_when"`
+	FailedWhen  string `yaml:"failed_when" json:"failed_when"`
+	// CheckSafe runs the command in check mode, it should be set only if
+	// the command does not change the runner
+	CheckSafe bool `yaml:"check_safe" json:"check_safe"`
+	// Notify is the names of the handlers of the job that run if the
+	// command has changed the runner
+	Notify []string
+	// Become runs Exec as BecomeUser (default root) with BecomeMethod, which
+	// can be "sudo" (default), "su" or "doas". If the password is required
+	// and BecomePassword is empty, it is asked once for each runner. It is
+	// inherited from the job and the parent if it is not set, and
+	// "become: false" opts out of it.
+	Become         *bool
+	BecomeUser     string `yaml:"become_user" json:"become_user"`
+	BecomeMethod   string `yaml:"become_method" json:"become_method"`
+	BecomePassword string `yaml:"become_password" json:"become_password"`
+	// Params is the config of the registered tags, see Action
+	Params map[string]interface{}
+	Env    Env
+	Args   Env
+	File   string
+
+	// passwords is the values of the password inputs of the jobs, they are
+	// masked in the log
+	passwords []string
+	// passwordKeys is the keys of the password inputs of the jobs, they are
+	// not exported to the shell
+	passwordKeys []string
+}
+
+// Secrets returns the values that should be masked in the log
+func (p *Command) Secrets() []string {
+	ret := make([]string, 0)
+	for _, it := range p.Expect {
+		if v := strings.TrimSpace(it.Send); it.Secret && v != "" {
+			ret = append(ret, v)
+		}
+	}
+
+	if p.BecomePassword != "" {
+		ret = append(ret, p.BecomePassword)
+	}
+	return append(ret, p.passwords...)
+}
+
+// MaskSecrets replaces the secrets in s with "******". The secrets are
+// always masked, even the short ones, so the longer secrets are replaced
+// first, in case that a secret contains another one.
+func MaskSecrets(s string, secrets []string) string {
+	list := append([]string{}, secrets...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return len(list[i]) > len(list[j])
+	})
+
+	for _, v := range list {
+		if v != "" {
+			s = strings.ReplaceAll(s, v, "******")
+		}
+	}
+
+	return s
+}
+
+// FileMode returns the file mode set by Mode, or def if Mode is empty
+func (p *Command) FileMode(def os.FileMode) (os.FileMode, error) {
+	if p.Mode == "" {
+		return def, nil
+	}
+
+	v, e := strconv.ParseUint(p.Mode, 8, 32)
+	if e != nil || v > 07777 {
+		return 0, fmt.Errorf("mode \"%s\" is invalid", p.Mode)
+	}
+
+	return os.FileMode(v), nil
+}
+
+// ShellArgs returns the arguments to run Exec with the shell
+func (p *Command) ShellArgs() []string {
+	return append(SplitCommand(p.Shell), p.Exec)
+}
+
+// internalEnvKeys are the variables of dbot that are not exported
+var internalEnvKeys = map[string]bool{"KeyESC": true, "KeyEnter": true}
+
+// ExportEnv returns the environment variables that are exported to the
+// process. The keys that are not valid shell identifiers, the internal
+// variables and the password inputs are ignored.
+func (p *Command) ExportEnv() []string {
+	passwordKeys := make(map[string]bool)
+	for _, key := range p.passwordKeys {
+		passwordKeys[key] = true
+	}
+
+	keys := make([]string, 0)
+	for key := range p.Env {
+		if envNameRegexp.MatchString(key) && !internalEnvKeys[key] &&
+			!passwordKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	ret := make([]string, len(keys))
+	for i, key := range keys {
+		ret[i] = key + "=" + p.Env[key]
+	}
+	return ret
+}
+
+// ShellScript returns the script to run Exec on a remote shell. The script
+// exports Env and changes the working directory to Cwd before running Exec.
+func (p *Command) ShellScript() string {
+	return p.shellScript(true)
+}
+
+// shellScript returns the script like ShellScript. If exportEnv is false,
+// Env is not exported by the script, it is set in other ways, such as the
+// environment of the ssh session.
+func (p *Command) shellScript(exportEnv bool) string {
+	sb := &strings.Builder{}
+
+	if exportEnv {
+		for _, v := range p.ExportEnv() {
+			kv := strings.SplitN(v, "=", 2)
+			sb.WriteString("export " + kv[0] + "=" + ShellQuote(kv[1]) + "\n")
+		}
+	}
+
+	if p.Cwd != "" {
+		sb.WriteString("cd " + ShellQuote(p.Cwd) + " || exit 1\n")
+	}
+
+	sb.WriteString(p.Exec)
+
+	args := SplitCommand(p.Shell)
+	for i := range args {
+		args[i] = ShellQuote(args[i])
+	}
+	ret := strings.Join(append(args, ShellQuote(sb.String())), " ")
+
+	if !p.IsBecome() {
+		return ret
+	}
+
+	// The marker tells that the privilege escalation has succeeded
+	script := ShellQuote("echo " + BecomeMarker + " && " + ret)
+	user := ShellQuote(p.BecomeUser)
+
+	switch p.BecomeMethod {
+	case "su":
+		return "su " + user + " -c " + script
+	case "doas":
+		return "doas -u " + user + " /bin/sh -c " + script
+	default:
+		return "sudo -H -S -p " + ShellQuote(BecomeSudoPrompt) +
+			" -u " + user + " /bin/sh -c " + script
+	}
+}
+
+// IsBecome reports whether Exec runs with the privilege escalation
+func (p *Command) IsBecome() bool {
+	return p.Become != nil && *p.Become
+}
+
+// BecomePrompt returns the regular expression of the password prompt of
+// BecomeMethod
+func (p *Command) BecomePrompt() *regexp.Regexp {
+	if p.BecomeMethod == "sudo" {
+		return regexp.MustCompile(regexp.QuoteMeta(BecomeSudoPrompt))
+	}
+
+	return regexp.MustCompile("(?i)password[^\\n]*:\\s*$")
+}
+
+// TtySize returns the width and height of the pseudo-terminal
+func (p *Command) TtySize() (int, int) {
+	width, _ := strconv.Atoi(p.TtyWidth)
+	height, _ := strconv.Atoi(p.TtyHeight)
+	return width, height
 }
 
 func GetStandradOut(s string) string {
@@ -120,6 +410,87 @@ func GetStandradOut(s string) string {
 	}
 }
 
+const (
+	// BecomeMarker is printed after the privilege escalation succeeded
+	BecomeMarker = "DBOT-BECOME-SUCCESS"
+	// BecomeSudoPrompt is the password prompt of sudo
+	BecomeSudoPrompt = "[dbot-become] password:"
+)
+
+var envNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// ansiRegexp matches the CSI, OSC and other escape sequences, and the
+// control characters except \t and \n
+var ansiRegexp = regexp.MustCompile(
+	"\x1b\\[[0-9;?]*[ -/]*[@-~]|" +
+		"\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|" +
+		"\x1b[PX^_][^\x1b]*\x1b\\\\|" +
+		"\x1b[ -/]*[0-~]|" +
+		"[\x00-\x08\x0b\x0c\x0e-\x1f\x7f]",
+)
+
+// sgrRegexp matches the colour (SGR) sequences
+var sgrRegexp = regexp.MustCompile("^\x1b\\[[0-9;]*m$")
+
+// StripANSI removes the terminal escape sequences and control characters
+// from s. If keepColor is true, the colour sequences are kept.
+func StripANSI(s string, keepColor bool) string {
+	// Carriage returns are used to redraw a line, keep the last one
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if idx := strings.LastIndex(line, "\r"); idx >= 0 {
+			lines[i] = line[idx+1:]
+		}
+	}
+
+	return ansiRegexp.ReplaceAllStringFunc(
+		strings.Join(lines, "\n"),
+		func(v string) string {
+			if keepColor && sgrRegexp.MatchString(v) {
+				return v
+			}
+			return ""
+		},
+	)
+}
+
+// FilterLines removes the lines of s that match any of the regular
+// expressions in filter
+func FilterLines(s string, filter []string) string {
+	if len(filter) == 0 || s == "" {
+		return s
+	}
+
+	regexps := make([]*regexp.Regexp, 0, len(filter))
+	for _, v := range filter {
+		if r, e := regexp.Compile(v); e == nil {
+			regexps = append(regexps, r)
+		}
+	}
+
+	ret := make([]string, 0)
+	for _, line := range strings.Split(s, "\n") {
+		matched := false
+		for _, r := range regexps {
+			if r.MatchString(StripANSI(line, false)) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			ret = append(ret, line)
+		}
+	}
+
+	return strings.Join(ret, "\n")
+}
+
+// ShellQuote quotes s for the POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
+
 func IsDir(path string) bool {
 	f, e := os.Stat(path)
 	return e == nil && f.Mode().IsDir()
@@ -130,53 +501,55 @@ func IsFile(path string) bool {
 	return e == nil && f.Mode().IsRegular()
 }
 
+// SplitCommand splits str into arguments like the POSIX shell does. The
+// quotes and escape characters are removed.
 func SplitCommand(str string) []string {
-	command := " " + str + " "
 	ret := make([]string, 0)
-	isSingleQuote := false
-	isDoubleQuotes := false
-	preChar := uint8(0)
-	cmdStart := -1
-
-	for i := 0; i < len(command); i++ {
-		if isSingleQuote {
-			if command[i] == 0x27 {
-				isSingleQuote = false
+	sb := &strings.Builder{}
+	inArg := false
+	quote := uint8(0)
+
+	for i := 0; i < len(str); i++ {
+		ch := str[i]
+
+		switch {
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			} else {
+				sb.WriteByte(ch)
 			}
-			preChar = command[i]
-			continue
-		}
-
-		if isDoubleQuotes {
-			if command[i] == 0x22 && preChar != 0x5C {
-				isDoubleQuotes = false
+		case quote == '"':
+			if ch == '"' {
+				quote = 0
+			} else if ch == '\\' && i+1 < len(str) &&
+				strings.IndexByte("\"\\$`", str[i+1]) >= 0 {
+				i++
+				sb.WriteByte(str[i])
+			} else {
+				sb.WriteByte(ch)
 			}
-			preChar = command[i]
-			continue
-		}
-
-		if command[i] == ' ' {
-			if cmdStart >= 0 {
-				ret = append(ret, command[cmdStart:i])
-				cmdStart = -1
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inArg = true
+		case ch == '\\' && i+1 < len(str):
+			i++
+			sb.WriteByte(str[i])
+			inArg = true
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inArg {
+				ret = append(ret, sb.String())
+				sb.Reset()
+				inArg = false
 			}
-			preChar = command[i]
-			continue
-		}
-
-		if cmdStart < 0 {
-			cmdStart = i
-		}
-
-		if command[i] == 0x27 {
-			isSingleQuote = true
-		}
-
-		if command[i] == 0x22 {
-			isDoubleQuotes = true
+		default:
+			sb.WriteByte(ch)
+			inArg = true
 		}
+	}
 
-		preChar = command[i]
+	if inArg {
+		ret = append(ret, sb.String())
 	}
 
 	return ret
@@ -0,0 +1,107 @@
+package dbot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	testCases := []struct {
+		str  string
+		want []string
+	}{
+		{"", []string{}},
+		{"ls -l  /tmp", []string{"ls", "-l", "/tmp"}},
+		{"echo 'a b' \"c d\"", []string{"echo", "a b", "c d"}},
+		{"echo a\\ b", []string{"echo", "a b"}},
+		{"echo \"a \\\"b\\\" \\$c\"", []string{"echo", "a \"b\" $c"}},
+		{"echo 'a\\b'", []string{"echo", "a\\b"}},
+		{"echo ''", []string{"echo", ""}},
+		{"echo a'b'c", []string{"echo", "abc"}},
+		{"\techo\na ", []string{"echo", "a"}},
+	}
+
+	for _, it := range testCases {
+		if got := SplitCommand(it.str); !reflect.DeepEqual(got, it.want) {
+			t.Errorf("SplitCommand(%q) = %q, want %q", it.str, got, it.want)
+		}
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	testCases := []struct {
+		str       string
+		keepColor bool
+		want      string
+	}{
+		{"plain\ttext\n", false, "plain\ttext\n"},
+		{"\x1b[1;32mok\x1b[0m", false, "ok"},
+		{"\x1b[1;32mok\x1b[0m", true, "\x1b[1;32mok\x1b[0m"},
+		{"\x1b[2K\x1b[1Gdone", true, "done"},
+		{"\x1b]0;title\x07text", false, "text"},
+		{"\x1b]0;title\x1b\\text", false, "text"},
+		{"a\x1b(Bb", false, "ab"},
+		{"10%\r50%\r100%\nnext", false, "100%\nnext"},
+		{"line\r\nnext\r\n", false, "line\nnext\n"},
+		{"bell\x07 back\x08", false, "bell back"},
+	}
+
+	for _, it := range testCases {
+		if got := StripANSI(it.str, it.keepColor); got != it.want {
+			t.Errorf(
+				"StripANSI(%q, %v) = %q, want %q",
+				it.str, it.keepColor, got, it.want,
+			)
+		}
+	}
+}
+
+func TestFilterLines(t *testing.T) {
+	testCases := []struct {
+		str    string
+		filter []string
+		want   string
+	}{
+		{"a\nb\nc", nil, "a\nb\nc"},
+		{"", []string{"a"}, ""},
+		{"a\nb\nc", []string{"^b$"}, "a\nc"},
+		{"warn: x\nok\nwarn: y", []string{"^warn:"}, "ok"},
+		{"\x1b[33mwarn: x\x1b[0m\nok", []string{"^warn:"}, "ok"},
+		{"a\nb", []string{"(", "^a$"}, "b"},
+		{"a\nb", []string{"a", "b"}, ""},
+	}
+
+	for _, it := range testCases {
+		if got := FilterLines(it.str, it.filter); got != it.want {
+			t.Errorf(
+				"FilterLines(%q, %q) = %q, want %q",
+				it.str, it.filter, got, it.want,
+			)
+		}
+	}
+}
+
+func TestMaskSecrets(t *testing.T) {
+	testCases := []struct {
+		str     string
+		secrets []string
+		want    string
+	}{
+		{"no secrets", nil, "no secrets"},
+		{"pw is hunter2", []string{"hunter2"}, "pw is ******"},
+		{"pw is abc", []string{"abc"}, "pw is ******"},
+		{"a1b1", []string{"1"}, "a******b******"},
+		{"x=hunter2", []string{"hunter", "hunter2"}, "x=******"},
+		{"a\nsecret\nb secret", []string{"secret"}, "a\n******\nb ******"},
+		{"empty", []string{""}, "empty"},
+	}
+
+	for _, it := range testCases {
+		if got := MaskSecrets(it.str, it.secrets); got != it.want {
+			t.Errorf(
+				"MaskSecrets(%q, %q) = %q, want %q",
+				it.str, it.secrets, got, it.want,
+			)
+		}
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/robertkrimen/otto"
@@ -20,16 +22,67 @@ type Context struct {
 	parent         *Context
 	runnerGroupMap map[string][]string
 	runnerMap      map[string]Runner
-	job            *Job
-	rawCmd         *Command
-	runCmd         *Command
-	runners        []Runner
-	path           string
-	file           string
+	runnerDataMap  map[string]*RunnerData
+	options        *Options
+	// inventoryMap caches the dynamic inventories during the run
+	inventoryMap map[string]*Inventory
+	// runnerVarsMap keeps the variables of the runners loaded by the job,
+	// such as the host variables of the inventory
+	runnerVarsMap map[string]Env
+	// runnerVars is the variables of the runners that are selected by "on"
+	// of the command or its parents
+	runnerVars map[string]Env
+	// step is the result of the running command on the runner
+	step *StepResult
+	// handlers is the notified handlers of the running job
+	handlers *handlerQueue
+	// guard receives the result of the guard that runs on the runner, the
+	// result is not logged
+	guard *guardResult
+	// hostIndex is the index of the runner in the runners of the command
+	// that is split by runners
+	hostIndex int
+	job       *Job
+	rawCmd    *Command
+	runCmd    *Command
+	runners   []Runner
+	path      string
+	file      string
+}
+
+// Options is the options of the whole run
+type Options struct {
+	// Inventory is the inventory file, its groups can be used by all jobs
+	Inventory string
+	// Limit restricts the runners of all the commands that have "on", it
+	// is a pattern like "on"
+	Limit string
+	// CacheTTL is how long the facts and the registered results are kept
+	// in the cache directory for the later runs. 0 disables the cache.
+	CacheTTL time.Duration
+	// Check predicts the changes without applying them. The commands that
+	// can not predict their changes are skipped unless they are check_safe.
+	Check bool
+	// Diff shows the diff of the files changed by copy and template
+	Diff bool
+	// Report is the file that the results of the commands are written to
+	// as JSON after the run, the durations are in seconds
+	Report string
 }
 
 // NewContext create the root context
 func NewContext(file string, jobName string) *Context {
+	return NewContextWithOptions(file, jobName, &Options{})
+}
+
+// NewContextWithOptions create the root context with the options
+func NewContextWithOptions(
+	file string, jobName string, options *Options,
+) *Context {
+	if options == nil {
+		options = &Options{}
+	}
+
 	vCtx := &Context{
 		runnerGroupMap: map[string][]string{
 			"local": {"local"},
@@ -37,53 +90,223 @@ func NewContext(file string, jobName string) *Context {
 		runnerMap: map[string]Runner{
 			"local": &LocalRunner{},
 		},
-		path:    jobName,
-		file:    "",
-		runners: []Runner{&LocalRunner{}},
-		runCmd:  &Command{Env: Env{}},
+		runnerDataMap: map[string]*RunnerData{},
+		options:       options,
+		inventoryMap:  map[string]*Inventory{},
+		runnerVarsMap: map[string]Env{},
+		path:          jobName,
+		file:          "",
+		runners:       []Runner{&LocalRunner{}},
+		runCmd:        &Command{Env: Env{}},
+	}
+
+	if options.Inventory != "" {
+		if !vCtx.Clone("inventory").loadInventory(options.Inventory) {
+			return nil
+		}
 	}
 
 	ret := vCtx.subContext(&Command{Tag: "job", Exec: jobName, File: file})
-	ret.parent = nil
+	if ret != nil {
+		ret.parent = nil
+	}
 	return ret
 }
 
 // subContext create sub Context
 func (p *Context) subContext(rawCmd *Command) *Context {
-	cmdEnv := p.runCmd.Env.Merge(p.runCmd.Env.ParseEnv(rawCmd.Env))
+	return p.subContextOn(rawCmd, nil, 0, nil)
+}
+
+// subContextOn create sub Context that runs on runners. If runners is nil,
+// they are selected by rawCmd.On. If the sub Context runs on one runner,
+// the variables of the runner override the inherited Env, and hostIndex is
+// the index of the runner. runnerVars is the variables of the runners.
+func (p *Context) subContextOn(
+	rawCmd *Command, runners []Runner, hostIndex int,
+	runnerVars map[string]Env,
+) *Context {
+	env := p.runCmd.Env
+	if runners == nil {
+		runners = p.runners
+		hostIndex = p.hostIndex
+		runnerVars = p.runnerVars
+		on := env.Merge(env.ParseEnv(rawCmd.Env)).
+			ParseString(rawCmd.On, "", true)
+
+		if on != "" {
+			v, ok := p.getRunners(on)
+			if !ok {
+				return nil
+			}
+			runners = v
+			hostIndex = 0
+			// The variables of the runners loaded by the job are used
+			// only if the runners are selected by "on"
+			runnerVars = p.runnerVarsMap
+		}
+	}
+
+	if len(runners) == 1 {
+		if p.job != nil && p.job.GatherFacts && !p.gatherFacts(runners[0]) {
+			return nil
+		}
+
+		env = env.Merge(p.getHostEnv(
+			runners[0], hostIndex, runnerVars[runners[0].Name()],
+		))
+	}
+
+	cmdEnv := env.Merge(env.ParseEnv(rawCmd.Env))
 	// Notice: if rawCmd tag is job, then runCmd.Env will change in init func
 	runCmd := &Command{
-		Tag:   cmdEnv.ParseString(rawCmd.Tag, "cmd", true),
-		Exec:  cmdEnv.ParseString(rawCmd.Exec, "", false),
-		On:    cmdEnv.ParseString(rawCmd.On, "", true),
-		Stdin: cmdEnv.ParseStringArray(rawCmd.Stdin),
-		Env:   cmdEnv,
-		Args:  cmdEnv.ParseEnv(rawCmd.Args),
-		File:  cmdEnv.ParseString(rawCmd.File, "", true),
+		Tag:           cmdEnv.ParseString(rawCmd.Tag, "cmd", true),
+		Exec:          cmdEnv.ParseString(rawCmd.Exec, "", false),
+		On:            cmdEnv.ParseString(rawCmd.On, "", true),
+		Stdin:         cmdEnv.ParseStringArray(rawCmd.Stdin),
+		Filter:        cmdEnv.ParseStringArray(rawCmd.Filter),
+		Tty:           rawCmd.Tty,
+		TtyTerm:       cmdEnv.ParseString(rawCmd.TtyTerm, "xterm", true),
+		TtyWidth:      cmdEnv.ParseString(rawCmd.TtyWidth, "80", true),
+		TtyHeight:     cmdEnv.ParseString(rawCmd.TtyHeight, "40", true),
+		Src:           cmdEnv.ParseString(rawCmd.Src, "", true),
+		Dest:          cmdEnv.ParseString(rawCmd.Dest, "", true),
+		Content:       cmdEnv.ParseString(rawCmd.Content, "", false),
+		Mode:          cmdEnv.ParseString(rawCmd.Mode, "", true),
+		Owner:         cmdEnv.ParseString(rawCmd.Owner, "", true),
+		FailOnMissing: rawCmd.FailOnMissing,
+		Register:      cmdEnv.ParseString(rawCmd.Register, "", true),
+		Delete:        rawCmd.Delete,
+		Exclude:       cmdEnv.ParseStringArray(rawCmd.Exclude),
+		Compare:       cmdEnv.ParseString(rawCmd.Compare, "mtime", true),
+		Shell:         cmdEnv.ParseString(rawCmd.Shell, "/bin/sh -c", true),
+		Cwd:           cmdEnv.ParseString(rawCmd.Cwd, "", true),
+		Creates:       cmdEnv.ParseString(rawCmd.Creates, "", true),
+		Removes:       cmdEnv.ParseString(rawCmd.Removes, "", true),
+		Unless:        cmdEnv.ParseString(rawCmd.Unless, "", false),
+		ChangedWhen:   cmdEnv.ParseString(rawCmd.ChangedWhen, "", true),
+		FailedWhen:    cmdEnv.ParseString(rawCmd.FailedWhen, "", true),
+		CheckSafe:     rawCmd.CheckSafe,
+		passwords:     p.runCmd.passwords,
+		passwordKeys:  p.runCmd.passwordKeys,
+		Notify:        cmdEnv.ParseStringArray(rawCmd.Notify),
+		Env:           cmdEnv,
+		Args:          cmdEnv.ParseEnv(rawCmd.Args),
+		File:          cmdEnv.ParseString(rawCmd.File, "", true),
+	}
+
+	// The privilege escalation is inherited from the job and the parent
+	parentJob := p.job
+	if parentJob == nil {
+		parentJob = &Job{}
+	}
+	become := p.runCmd.IsBecome() || parentJob.Become
+	if rawCmd.Become != nil {
+		become = *rawCmd.Become
+	}
+	runCmd.BecomeUser = cmdEnv.ParseFirst(
+		rawCmd.BecomeUser, parentJob.BecomeUser, p.runCmd.BecomeUser, "root",
+	)
+	runCmd.BecomeMethod = cmdEnv.ParseFirst(
+		rawCmd.BecomeMethod, parentJob.BecomeMethod, p.runCmd.BecomeMethod,
+		"sudo",
+	)
+	runCmd.BecomePassword = cmdEnv.ParseFirst(
+		rawCmd.BecomePassword, parentJob.BecomePassword,
+		p.runCmd.BecomePassword,
+	)
+
+	// The files are transferred as the login user, so the file tags do not
+	// support become, and the inherited become is not applied to them
+	switch runCmd.Tag {
+	case "copy", "fetch", "template", "sync":
+		if rawCmd.IsBecome() {
+			p.Clone("%s.become", p.path).LogError(
+				"unsupported become on tag \"%s\"", runCmd.Tag,
+			)
+			return nil
+		}
+		become = false
+	}
+	runCmd.Become = &become
+
+	switch runCmd.BecomeMethod {
+	case "sudo":
+	case "su", "doas":
+		// su and doas read the password from the terminal
+		runCmd.Tty = runCmd.Tty || become
+	default:
+		p.Clone("%s.become_method", p.path).LogError(
+			"unsupported become_method \"%s\"", runCmd.BecomeMethod,
+		)
+		return nil
+	}
+
+	for _, it := range rawCmd.Expect {
+		if it != nil {
+			runCmd.Expect = append(runCmd.Expect, &Expect{
+				Pattern: cmdEnv.ParseString(it.Pattern, "", false),
+				Send:    cmdEnv.ParseString(it.Send, "", false),
+				Timeout: cmdEnv.ParseString(it.Timeout, "30s", true),
+				Secret:  it.Secret,
+			})
+		}
 	}
 
 	file := p.file
-	runners := p.runners
 	path := p.path
 	job := p.job
 
+	var action Action
+
 	switch runCmd.Tag {
-	case "cmd", "script":
-		if len(rawCmd.Args) > 0 {
-			p.Clone("%s.args", p.path).LogError(
-				"unsupported args on tag \"%s\"", runCmd.Tag,
+	case "job":
+		if len(rawCmd.Stdin) > 0 {
+			p.Clone("%s.stdin", p.path).LogError(
+				"unsupported stdin on tag \"%s\"", runCmd.Tag,
 			)
 		}
 
-		if rawCmd.File != "" {
-			p.Clone("%s.file", p.path).LogError(
-				"unsupported file on tag \"%s\"", runCmd.Tag,
+		if len(rawCmd.Filter) > 0 {
+			p.Clone("%s.filter", p.path).LogError(
+				"unsupported filter on tag \"%s\"", runCmd.Tag,
 			)
 		}
-	case "job":
-		if len(rawCmd.Stdin) > 0 {
-			p.Clone("%s.stdin", p.path).LogError(
-				"unsupported stdin on tag \"%s\"", runCmd.Tag,
+
+		if len(rawCmd.Expect) > 0 {
+			p.Clone("%s.expect", p.path).LogError(
+				"unsupported expect on tag \"%s\"", runCmd.Tag,
+			)
+		}
+
+		if rawCmd.Tty {
+			p.Clone("%s.tty", p.path).LogError(
+				"unsupported tty on tag \"%s\"", runCmd.Tag,
+			)
+		}
+
+		if rawCmd.Register != "" {
+			p.Clone("%s.register", p.path).LogError(
+				"unsupported register on tag \"%s\"", runCmd.Tag,
+			)
+		}
+
+		if len(rawCmd.Params) > 0 {
+			p.Clone("%s.params", p.path).LogError(
+				"unsupported params on tag \"%s\"", runCmd.Tag,
+			)
+		}
+
+		if rawCmd.ChangedWhen != "" || rawCmd.FailedWhen != "" {
+			p.Clone("%s.changed_when", p.path).LogError(
+				"unsupported changed_when and failed_when on tag \"%s\"",
+				runCmd.Tag,
+			)
+		}
+
+		if len(rawCmd.Notify) > 0 {
+			p.Clone("%s.notify", p.path).LogError(
+				"unsupported notify on tag \"%s\"", runCmd.Tag,
 			)
 		}
 
@@ -113,33 +336,51 @@ func (p *Context) subContext(rawCmd *Command) *Context {
 		path = runCmd.Exec
 		runCmd.Env = nil
 	default:
-		p.Clone("%s.tag", p.path).LogError("unsupported tag \"%s\"", runCmd.Tag)
-		return nil
-	}
+		v, ok := getAction(runCmd.Tag)
+		if !ok {
+			// Find the external action in the directory of the config file
+			// and PATH
+			v, ok = p.findExternalAction(runCmd.Tag)
+		}
+		if !ok {
+			p.Clone("%s.tag", p.path).
+				LogError("unsupported tag \"%s\"", runCmd.Tag)
+			return nil
+		}
+		action = v
 
-	// Set runners
-	if runCmd.On != "" {
-		if v := p.getRunners(runCmd.On); len(v) > 0 {
-			runners = v
-		} else {
+		params, ok := p.Clone("%s.params", p.path).
+			parseParams(action.Params(), rawCmd.Params, cmdEnv)
+		if !ok {
 			return nil
 		}
+		runCmd.Params = params
 	}
 
-	// clone runnerGroupMap
+	// clone runnerGroupMap and runnerVarsMap
 	runnerGroupMap := make(map[string][]string)
 	for key, value := range p.runnerGroupMap {
 		runnerGroupMap[key] = value
 	}
+	runnerVarsMap := make(map[string]Env)
+	for key, value := range p.runnerVarsMap {
+		runnerVarsMap[key] = value
+	}
 
 	ret := &Context{
 		runnerGroupMap: runnerGroupMap,
 		runnerMap:      p.runnerMap,
+		runnerDataMap:  p.runnerDataMap,
+		options:        p.options,
+		inventoryMap:   p.inventoryMap,
+		runnerVarsMap:  runnerVarsMap,
+		runnerVars:     runnerVars,
 		job:            job,
 		parent:         p,
 		rawCmd:         rawCmd,
 		runCmd:         runCmd,
 		runners:        runners,
+		hostIndex:      hostIndex,
 		path:           path,
 		file:           file,
 	}
@@ -148,6 +389,8 @@ func (p *Context) subContext(rawCmd *Command) *Context {
 		if !ret.initJob() {
 			return nil
 		}
+	} else if !action.Check(ret) || !ret.checkNotify() {
+		return nil
 	}
 
 	return ret
@@ -156,10 +399,17 @@ func (p *Context) subContext(rawCmd *Command) *Context {
 func (p *Context) initJob() bool {
 	// init jobEnv
 	rootEnv := p.getRootEnv()
+	if len(p.runners) == 1 {
+		rootEnv = rootEnv.Merge(p.getHostEnv(
+			p.runners[0], p.hostIndex, p.runnerVars[p.runners[0].Name()],
+		))
+	}
 	jobEnv := rootEnv.
 		Merge(rootEnv.ParseEnv(p.job.Env)).
 		Merge(p.runCmd.Args)
 	tmpEnv := jobEnv.Merge(Env{})
+	p.runCmd.passwords = append([]string{}, p.runCmd.passwords...)
+	p.runCmd.passwordKeys = append([]string{}, p.runCmd.passwordKeys...)
 	for key, it := range p.job.Inputs {
 		itDesc := tmpEnv.ParseString(it.Desc, "input "+key+": ", false)
 		itType := tmpEnv.ParseString(it.Type, "text", true)
@@ -169,54 +419,168 @@ func (p *Context) initJob() bool {
 			return false
 		}
 		jobEnv[key] = tmpEnv.ParseString(value, "", false)
+
+		if itType == "password" && jobEnv[key] != "" {
+			p.runCmd.passwords = append(p.runCmd.passwords, jobEnv[key])
+			p.runCmd.passwordKeys = append(p.runCmd.passwordKeys, key)
+		}
 	}
 	p.runCmd.Env = jobEnv
 
+	// Load plugins
+	for idx, it := range p.job.Plugins {
+		path := p.getLocalPath(jobEnv.ParseString(it, "", true))
+		if e := LoadPlugin(path); e != nil {
+			p.Clone("%s.plugins[%d]", p.path, idx).LogError(e.Error())
+			return false
+		}
+	}
+
+	// Check handlers, they run on the runners where they are notified
+	for name, it := range p.job.Handlers {
+		if it == nil {
+			p.Clone("%s.handlers.%s", p.path, name).LogError("handler is empty")
+			return false
+		} else if it.On != "" {
+			p.Clone("%s.handlers.%s.on", p.path, name).LogError(
+				"unsupported on in handlers",
+			)
+			return false
+		}
+	}
+
 	// Load imports
 	for key, it := range p.job.Imports {
+		itType := jobEnv.ParseString(it.Type, "remotes", true)
 		itName := jobEnv.ParseString(it.Name, "", true)
 		itFile := jobEnv.ParseString(it.File, "", true)
-		config := make(map[string][]*Remote)
+		itCtx := p.Clone("%s.imports.%s", p.path, key)
+		var importGroup []string
 
-		if absFile, ok := p.Clone("%s.imports.%s", p.path, key).
-			loadConfig(itFile, config); !ok {
-			return false
-		} else if item, ok := config[itName]; !ok {
-			return false
-		} else {
-			sshGroup := (&Context{
-				parent:         p,
-				runnerGroupMap: p.runnerGroupMap,
-				runnerMap:      p.runnerMap,
-				path:           itName,
-				file:           absFile,
-				runners:        p.runners,
-			}).loadSSHGroup(item, Env{})
-
-			if sshGroup == nil {
+		switch itType {
+		case "remotes":
+			config := make(map[string][]*Remote)
+
+			if absFile, ok := itCtx.loadConfig(itFile, config); !ok {
+				return false
+			} else if item, ok := config[itName]; !ok {
+				itCtx.LogError(
+					"could not find group \"%s\" in \"%s\"", itName, absFile,
+				)
 				return false
+			} else {
+				importGroup = (&Context{
+					parent:         p,
+					runnerGroupMap: p.runnerGroupMap,
+					runnerMap:      p.runnerMap,
+					runnerDataMap:  p.runnerDataMap,
+					options:        p.options,
+					inventoryMap:   p.inventoryMap,
+					runnerVarsMap:  p.runnerVarsMap,
+					hostIndex:      p.hostIndex,
+					path:           itName,
+					file:           absFile,
+					runners:        p.runners,
+				}).loadRemoteGroup(item, Env{})
 			}
+		case "inventory", "exec", "script":
+			importGroup = itCtx.loadInventoryGroup(
+				itType, itFile, itName, jobEnv.ParseEnv(it.Env),
+			)
+		default:
+			itCtx.Clone("%s.type", itCtx.path).
+				LogError("unsupported import type \"%s\"", itType)
+			return false
+		}
 
-			p.runnerGroupMap[key] = sshGroup
+		if importGroup == nil {
+			return false
 		}
+
+		p.runnerGroupMap[key] = importGroup
 	}
 
 	// Load remotes
 	for key, list := range p.job.Remotes {
-		sshGroup := p.Clone("%s.remotes.%s", p.path, key).
-			loadSSHGroup(list, jobEnv)
+		remoteGroup := p.Clone("%s.remotes.%s", p.path, key).
+			loadRemoteGroup(list, jobEnv)
 
-		if sshGroup == nil {
+		if remoteGroup == nil {
 			return false
 		}
 
-		p.runnerGroupMap[key] = sshGroup
+		p.runnerGroupMap[key] = remoteGroup
+	}
+
+	// Load containers
+	for key, list := range p.job.Containers {
+		dockerGroup := p.Clone("%s.containers.%s", p.path, key).
+			loadDockerGroup(list, jobEnv)
+
+		if dockerGroup == nil {
+			return false
+		}
+
+		p.runnerGroupMap[key] = dockerGroup
+	}
+
+	// Load pods, the members of the group are the pods running now
+	for key, it := range p.job.Pods {
+		podGroup := p.Clone("%s.pods.%s", p.path, key).
+			loadKubernetesGroup(it, jobEnv)
+
+		if podGroup == nil {
+			return false
+		}
+
+		p.runnerGroupMap[key] = podGroup
 	}
 
 	return true
 }
 
-func (p *Context) loadSSHGroup(list []*Remote, env Env) []string {
+func (p *Context) loadKubernetesGroup(pods *Pods, env Env) []string {
+	if pods == nil {
+		p.LogError("pods is empty")
+		return nil
+	}
+
+	namespace := env.ParseString(pods.Namespace, "default", true)
+	selector := env.ParseString(pods.Selector, "", true)
+	container := env.ParseString(pods.Container, "", true)
+	context := env.ParseString(pods.Context, "", true)
+	kubectl := env.ParseString(pods.Kubectl, "kubectl", true)
+
+	names, e := FindKubernetesPods(kubectl, context, namespace, selector)
+	if e != nil {
+		p.LogError(e.Error())
+		return nil
+	} else if len(names) == 0 {
+		p.LogError(
+			"could not find any running pods by \"%s\" in namespace \"%s\"",
+			selector, namespace,
+		)
+		return nil
+	}
+
+	ret := make([]string, 0)
+	for _, name := range names {
+		runner := NewKubernetesRunner(
+			kubectl, context, namespace, name, container,
+		)
+		id := runner.Name()
+
+		if _, ok := p.runnerMap[id]; !ok {
+			p.runnerMap[id] = runner
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret
+}
+
+func (p *Context) loadDockerGroup(list []*Container, env Env) []string {
 	if len(list) == 0 {
 		p.LogError("list is empty")
 		return nil
@@ -224,22 +588,95 @@ func (p *Context) loadSSHGroup(list []*Remote, env Env) []string {
 
 	ret := make([]string, 0)
 	for idx, it := range list {
-		host := env.ParseString(it.Host, "", true)
-		user := env.ParseString(it.User, os.Getenv("USER"), true)
-		port := env.ParseString(it.Port, "22", true)
+		name := env.ParseString(it.Name, "", true)
+		user := env.ParseString(it.User, "", true)
+		docker := env.ParseString(it.Docker, "docker", true)
 
-		id := fmt.Sprintf("%s@%s:%s", user, host, port)
+		if name == "" {
+			p.Clone("%s[%d].name", p.path, idx).LogError("name is empty")
+			return nil
+		}
+
+		id := "docker:" + name
 
 		if _, ok := p.runnerMap[id]; !ok {
-			ssh := NewSSHRunner(
-				p.Clone("%s[%d]", p.path, idx), port, user, host,
+			runner := NewDockerRunner(
+				p.Clone("%s[%d]", p.path, idx), docker, name, user,
 			)
 
-			if ssh == nil {
+			if runner == nil {
 				return nil
 			}
 
-			p.runnerMap[id] = ssh
+			p.runnerMap[id] = runner
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret
+}
+
+func (p *Context) loadRemoteGroup(list []*Remote, env Env) []string {
+	if len(list) == 0 {
+		p.LogError("list is empty")
+		return nil
+	}
+
+	ret := make([]string, 0)
+	for idx, it := range list {
+		itCtx := p.Clone("%s[%d]", p.path, idx)
+		itType := env.ParseString(it.Type, "ssh", true)
+		factory, ok := getRunnerFactory(itType)
+		if !ok {
+			itCtx.Clone("%s.type", itCtx.path).
+				LogError("unsupported runner type \"%s\"", itType)
+			return nil
+		}
+
+		config := map[string]string{}
+		for key, value := range it.Config {
+			config[key] = env.ParseString(value, "", true)
+		}
+
+		if itType == "ssh" {
+			config["host"] = env.ParseString(it.Host, "", true)
+			config["user"] = env.ParseString(it.User, os.Getenv("USER"), true)
+			config["port"] = env.ParseString(it.Port, "22", true)
+		} else {
+			fnSet := func(key string, value string) {
+				if value = env.ParseString(value, "", true); value != "" {
+					config[key] = value
+				}
+			}
+			fnSet("host", it.Host)
+			fnSet("user", it.User)
+			fnSet("port", it.Port)
+		}
+
+		runner := factory(itCtx, config)
+		if runner == nil {
+			return nil
+		}
+
+		// The built-in local runner is in the group "local"
+		id := runner.Name()
+		if v, ok := runner.(*LocalRunner); ok && v == p.runnerMap["local"] {
+			id = "local"
+		} else if _, ok := p.runnerMap[id]; !ok {
+			p.runnerMap[id] = runner
+		}
+
+		// The host variables, such as ${HostName}, are parsed when the
+		// command runs on the runner. They are kept by the runner name.
+		if len(it.Vars) > 0 {
+			varsEnv := env.Merge(nil)
+			for _, key := range hostEnvKeys {
+				delete(varsEnv, key)
+			}
+			name := runner.Name()
+			p.runnerVarsMap[name] = p.runnerVarsMap[name].
+				Merge(varsEnv.ParseEnv(it.Vars))
 		}
 
 		ret = append(ret, id)
@@ -257,41 +694,73 @@ func (p *Context) getRootEnv() Env {
 	})
 }
 
-func (p *Context) getRunners(runOn string) []Runner {
-	ret := make([]Runner, 0)
+// getLocalPath returns the path on the local machine. The relative path
+// is relative to the directory of the config file
+func (p *Context) getLocalPath(path string) string {
+	if filepath.IsAbs(path) || p.file == "" {
+		return path
+	}
 
-	for _, groupName := range strings.Split(runOn, ",") {
-		if groupName = strings.TrimSpace(groupName); groupName != "" {
-			runnersName, ok := p.runnerGroupMap[groupName]
+	return filepath.Join(filepath.Dir(p.file), path)
+}
 
-			if !ok {
-				p.LogError("could not find group \"%s\"", groupName)
-				return nil
-			}
+// getRunners returns the runners selected by the pattern runOn, and
+// restricted by the limit of the run. The result is empty if all the
+// runners are excluded by the limit.
+func (p *Context) getRunners(runOn string) ([]Runner, bool) {
+	names, ok := p.selectRunners(runOn)
+	if !ok {
+		return nil, false
+	} else if len(names) == 0 {
+		p.LogError("could not find any runners by \"%s\"", runOn)
+		return nil, false
+	}
 
-			for _, runnerName := range runnersName {
-				runner, ok := p.runnerMap[runnerName]
-				if !ok {
-					p.LogError("could not find runner \"%s\"", runnerName)
-					return nil
-				}
-				ret = append(ret, runner)
+	if limit := p.options.Limit; limit != "" {
+		limitNames, ok := p.Clone("limit").selectRunners(limit)
+		if !ok {
+			return nil, false
+		}
+
+		limitSet := make(map[string]bool)
+		for _, name := range limitNames {
+			limitSet[name] = true
+		}
+
+		limited := make([]string, 0, len(names))
+		for _, name := range names {
+			if limitSet[name] {
+				limited = append(limited, name)
 			}
 		}
+		names = limited
 	}
 
-	if len(ret) == 0 {
-		p.LogError("could not find any runners")
-		return nil
+	ret := make([]Runner, 0, len(names))
+	for _, name := range names {
+		runner, ok := p.runnerMap[name]
+		if !ok {
+			p.LogError("could not find runner \"%s\"", name)
+			return nil, false
+		}
+		ret = append(ret, runner)
 	}
 
-	return ret
+	return ret, true
 }
 
 func (p *Context) Clone(format string, a ...interface{}) *Context {
 	return &Context{
 		runnerGroupMap: p.runnerGroupMap,
 		runnerMap:      p.runnerMap,
+		runnerDataMap:  p.runnerDataMap,
+		options:        p.options,
+		inventoryMap:   p.inventoryMap,
+		runnerVarsMap:  p.runnerVarsMap,
+		runnerVars:     p.runnerVars,
+		hostIndex:      p.hostIndex,
+		step:           p.step,
+		handlers:       p.handlers,
 		job:            p.job,
 		parent:         p.parent,
 		rawCmd:         p.rawCmd,
@@ -302,42 +771,176 @@ func (p *Context) Clone(format string, a ...interface{}) *Context {
 	}
 }
 
+// Command returns the command of the context, its strings have been parsed
+// with the Env
+func (p *Context) Command() *Command {
+	return p.runCmd
+}
+
+// Runner returns the runner that the command runs on, it is nil if the
+// command runs on multiple runners
+func (p *Context) Runner() Runner {
+	if len(p.runners) != 1 {
+		return nil
+	}
+	return p.runners[0]
+}
+
+// Path returns the path of the command in the config files
+func (p *Context) Path() string {
+	return p.path
+}
+
+// CheckMode reports whether the changes should be predicted but not applied
+func (p *Context) CheckMode() bool {
+	return p.options != nil && p.options.Check
+}
+
 func (p *Context) Run() bool {
+	// The root context prints the recap, saves the report and the cache
+	// after the run
+	if p.parent == nil {
+		defer func() {
+			p.logRecap()
+			p.saveReport()
+			p.saveRunnerCache()
+		}()
+	}
+
 	if len(p.runners) == 0 {
-		// Check
-		p.Clone("kernel error: runners must be checked in previous call")
-		return false
+		// All the runners are excluded by the limit
+		p.LogInfo("skipped: no runners match the limit")
+		return true
+	} else if len(p.runners) == 1 && p.hasFailed(p.runners[0]) {
+		// The runner is removed from the run after it has failed
+		p.LogInfo("skipped: the runner has failed")
+		return true
 	} else if len(p.runners) == 1 {
 		// If len(p.runners) == 1. Run it
-		switch p.runCmd.Tag {
-		case "job":
-			return p.runJob()
-		case "cmd":
-			return p.runCommand()
-		case "script":
-			return p.runScript()
-		default:
-			p.Clone("kernel error: type must be checked in previous call")
+		if p.runCmd.Tag != "job" {
+			return p.runStep(p.runAction)
+		}
+
+		if reason, ok := p.checkGuards(); !ok {
 			return false
+		} else if reason != "" {
+			p.LogInfo("ok (skipped): %s", reason)
+			return true
 		}
+
+		return p.runJob()
 	} else {
-		// If len(p.runners) > 1, Split the context by runners.
-		for _, runner := range p.runners {
-			ctx := p.Clone(p.path)
-			ctx.runners = []Runner{runner}
-			if !ctx.Run() {
-				return false
+		// If len(p.runners) > 1, Split the context by runners. If the
+		// command fails on a runner, it still runs on the other runners,
+		// and it fails only if it fails on all of them.
+		ok := false
+		for idx, runner := range p.runners {
+			if p.hasFailed(runner) {
+				continue
+			}
+
+			if ctx := p.onRunner(runner, idx); ctx == nil {
+				p.failOn(runner)
+			} else if ctx.Run() {
+				ok = true
 			}
 		}
 
+		return ok
+	}
+}
+
+// failOn records that the command has failed on the runner, unless the
+// failure has been recorded, such as the runner is unreachable
+func (p *Context) failOn(runner Runner) {
+	if !p.hasFailed(runner) {
+		p.getRunnerDataByName(runner.Name()).AddStep(&StepResult{
+			Runner: runner.Name(),
+			Path:   p.path,
+			Tag:    p.runCmd.Tag,
+			Status: StatusFailed,
+		})
+	}
+}
+
+// hasFailed reports whether a command has failed on the runner
+func (p *Context) hasFailed(runner Runner) bool {
+	return p.getRunnerDataByName(runner.Name()).HasFailed()
+}
+
+// runAction runs the action of the tag on the runner
+func (p *Context) runAction() bool {
+	if reason, ok := p.checkGuards(); !ok {
+		return false
+	} else if reason != "" {
+		p.SetStatus(StatusSkipped)
+		p.LogInfo("ok (skipped): %s", reason)
 		return true
 	}
+
+	if p.CheckMode() && !p.runCmd.CheckSafe && !checkModeTags[p.runCmd.Tag] {
+		// The guards predict that the command would change the runner
+		if p.runCmd.Creates != "" || p.runCmd.Removes != "" ||
+			p.runCmd.Unless != "" {
+			p.SetStatus(StatusChanged)
+			p.LogInfo("changed: check mode, the command would run")
+			return true
+		}
+
+		p.SetStatus(StatusSkipped)
+		p.LogInfo("skipped: check mode, the command is not check_safe")
+		return true
+	}
+
+	if action, ok := getAction(p.runCmd.Tag); ok {
+		return action.Run(p)
+	} else if action, ok := p.findExternalAction(p.runCmd.Tag); ok {
+		return action.Run(p)
+	} else {
+		p.LogError("kernel error: tag must be checked in previous call")
+		return false
+	}
+}
+
+// onRunner returns the context that runs on runner only. The command is
+// parsed again, so that it can use the variables of the runner.
+func (p *Context) onRunner(runner Runner, hostIndex int) *Context {
+	// The commands of the job are parsed when they run on the runner
+	if p.runCmd.Tag == "job" || p.parent == nil || p.rawCmd == nil {
+		runCmd := *p.runCmd
+		runCmd.Env = runCmd.Env.Merge(
+			p.getHostEnv(runner, hostIndex, p.runnerVars[runner.Name()]),
+		)
+		ret := p.Clone(p.path)
+		ret.runCmd = &runCmd
+		ret.runners = []Runner{runner}
+		ret.hostIndex = hostIndex
+		return ret
+	}
+
+	ret := p.parent.subContextOn(
+		p.rawCmd, []Runner{runner}, hostIndex, p.runnerVars,
+	)
+	if ret != nil {
+		ret.path = p.path
+	}
+
+	return ret
 }
 
 func (p *Context) runJob() bool {
+	p.handlers = newHandlerQueue()
+
 	// If the commands are run in sequence, run them one by one and return
 	if !p.job.Async {
 		for i := 0; i < len(p.job.Commands); i++ {
+			if p.job.Commands[i].Tag == flushHandlersTag {
+				if !p.flushHandlers() {
+					return false
+				}
+				continue
+			}
+
 			ctx := p.Clone("%s.commands[%d]", p.runCmd.Exec, i).
 				subContext(p.job.Commands[i])
 
@@ -350,7 +953,7 @@ func (p *Context) runJob() bool {
 			}
 		}
 
-		return true
+		return p.flushHandlers()
 	}
 
 	// The commands are run async
@@ -358,6 +961,14 @@ func (p *Context) runJob() bool {
 
 	for i := 0; i < len(p.job.Commands); i++ {
 		go func(idx int) {
+			if p.job.Commands[idx].Tag == flushHandlersTag {
+				p.Clone("%s.commands[%d]", p.runCmd.Exec, idx).LogError(
+					"unsupported tag \"%s\" in async jobs", flushHandlersTag,
+				)
+				waitCH <- false
+				return
+			}
+
 			ctx := p.Clone("jobs.%s.commands[%d]", p.runCmd.Exec, idx).
 				subContext(p.job.Commands[idx])
 
@@ -377,7 +988,7 @@ func (p *Context) runJob() bool {
 		}
 	}
 
-	return ret
+	return ret && p.flushHandlers()
 }
 
 func (p *Context) runScript() bool {
@@ -392,6 +1003,8 @@ func (p *Context) runScript() bool {
 		ctx:    p,
 		seed:   0,
 	})
+	// The facts of the runner, they are empty if they are not gathered
+	_ = vm.Set("facts", map[string]string(p.getRunnerData().GetFacts()))
 	_, e := vm.Run(p.runCmd.Exec)
 
 	p.Log(stdout.String(), stderr.String())
@@ -407,6 +1020,69 @@ func (p *Context) runCommand() bool {
 	return p.runners[0].Run(p)
 }
 
+// getRunnerData returns the data of the runner that the context runs on
+func (p *Context) getRunnerData() *RunnerData {
+	return p.getRunnerDataByName(p.runners[0].Name())
+}
+
+var hostEnvKeys = []string{"HostName", "HostUser", "HostPort", "HostIndex"}
+
+// getHostEnv returns the variables of the runner. hostIndex is the index of
+// the runner in the runners of the command, and vars is the variables of
+// the runner in the job, such as the host variables of the inventory.
+func (p *Context) getHostEnv(runner Runner, hostIndex int, vars Env) Env {
+	info := runnerInfo(runner)
+	runnerData := p.getRunnerDataByName(runner.Name())
+	ret := Env{
+		"HostName":  info["host"],
+		"HostUser":  info["user"],
+		"HostPort":  info["port"],
+		"HostIndex": strconv.Itoa(hostIndex),
+	}
+
+	for key, value := range runnerData.GetFacts() {
+		ret["facts."+key] = value
+	}
+
+	return ret.Merge(ret.ParseEnv(vars))
+}
+
+// getRunnerDataByName returns the data of the runner with the name
+func (p *Context) getRunnerDataByName(name string) *RunnerData {
+	gRunnerDataLock.Lock()
+	defer gRunnerDataLock.Unlock()
+
+	if ret, ok := p.runnerDataMap[name]; ok {
+		return ret
+	}
+
+	ret := NewRunnerData()
+	if p.options.CacheTTL > 0 {
+		ret.loadCache(name, p.options.CacheTTL)
+	}
+	p.runnerDataMap[name] = ret
+	return ret
+}
+
+// getExpectBecome returns how to answer the password prompt of the
+// privilege escalation, it returns nil if runCmd does not become
+func (p *Context) getExpectBecome() *ExpectBecome {
+	if !p.runCmd.IsBecome() {
+		return nil
+	}
+
+	return &ExpectBecome{
+		Prompt: p.runCmd.BecomePrompt(),
+		Password: func(retry bool) (string, bool) {
+			if p.runCmd.BecomePassword != "" {
+				return p.runCmd.BecomePassword, !retry
+			}
+
+			return p.getRunnerData().GetBecomePassword(p, retry)
+		},
+	}
+}
+
 func (p *Context) getRunnersName() string {
 	nameArray := make([]string, 0)
 
@@ -0,0 +1,252 @@
+package dbot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const diffContextLines = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines returns the shortest edit script from a to b, using the Myers
+// diff algorithm
+func diffLines(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] keeps v[-d-1 .. d+1] before the step d
+	trace := make([][]int, 0)
+
+	fnGet := func(d int, k int) int {
+		return trace[d][k+d+1]
+	}
+
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, d, fnGet)
+			}
+		}
+	}
+
+	return nil
+}
+
+func backtrackDiff(
+	a []string, b []string, depth int, fnGet func(d int, k int) int,
+) []diffOp {
+	ret := make([]diffOp, 0)
+	x, y := len(a), len(b)
+
+	for d := depth; d > 0; d-- {
+		k := x - y
+		prevK := 0
+		if k == -d || (k != d && fnGet(d, k-1) < fnGet(d, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := fnGet(d, prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ret = append(ret, diffOp{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+
+		if x == prevX {
+			ret = append(ret, diffOp{kind: '+', line: b[y-1]})
+			y--
+		} else {
+			ret = append(ret, diffOp{kind: '-', line: a[x-1]})
+			x--
+		}
+	}
+
+	for x > 0 && y > 0 {
+		ret = append(ret, diffOp{kind: ' ', line: a[x-1]})
+		x--
+		y--
+	}
+
+	// Reverse the edit script
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+
+	return ret
+}
+
+func splitLines(s string) []string {
+	ret := strings.SplitAfter(s, "\n")
+	if ret[len(ret)-1] == "" {
+		ret = ret[:len(ret)-1]
+	}
+
+	return ret
+}
+
+// UnifiedDiff returns the unified diff from oldText to newText. It returns
+// "" if they are the same.
+func UnifiedDiff(
+	oldName string, newName string, oldText string, newText string,
+) string {
+	if oldText == newText {
+		return ""
+	}
+
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+	sb := &strings.Builder{}
+	sb.WriteString("--- " + oldName + "\n")
+	sb.WriteString("+++ " + newName + "\n")
+
+	// oldLines[i] and newLines[i] are the line numbers before ops[i]
+	oldLines := make([]int, len(ops)+1)
+	newLines := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldLines[i+1], newLines[i+1] = oldLines[i], newLines[i]
+		if op.kind != '+' {
+			oldLines[i+1]++
+		}
+		if op.kind != '-' {
+			newLines[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Find the end of the hunk
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContextLines {
+				break
+			}
+		}
+		if end += diffContextLines; end > len(ops) {
+			end = len(ops)
+		}
+
+		_, _ = fmt.Fprintf(
+			sb,
+			"@@ -%s +%s @@\n",
+			hunkRange(oldLines[start], oldLines[end]-oldLines[start]),
+			hunkRange(newLines[start], newLines[end]-newLines[start]),
+		)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return sb.String()
+}
+
+func hunkRange(start int, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	} else if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	} else {
+		return fmt.Sprintf("%d,%d", start+1, length)
+	}
+}
+
+// maxDiffSize is the max size of the files that are compared for the diff
+const maxDiffSize = 64 * 1024
+
+// minSecretLength is the min length of the Env values that are masked by
+// their names, the shorter values such as "1" would be masked everywhere
+const minSecretLength = 4
+
+var secretEnvRegexp = regexp.MustCompile(
+	`(?i)(password|passwd|secret|token|private_?key|api_?key|credential)`,
+)
+
+// showDiff reports whether the diff of the changed files is shown
+func (p *Context) showDiff() bool {
+	return p.options != nil && (p.options.Diff || p.options.Check)
+}
+
+// diffSecrets returns the values that are masked in the diff. They are the
+// secrets of the command and the Env values whose names look like secrets.
+func (p *Context) diffSecrets() []string {
+	ret := p.runCmd.Secrets()
+	if v := p.getRunnerData().getBecomePassword(); v != "" {
+		ret = append(ret, v)
+	}
+
+	for key, value := range p.runCmd.Env {
+		if len(value) >= minSecretLength && secretEnvRegexp.MatchString(key) {
+			ret = append(ret, value)
+		}
+	}
+
+	return ret
+}
+
+// fileDiff returns the diff of the file name from oldText to newText for
+// the log and the result of the command. The secrets are masked, and the
+// large, binary and private key files are not compared.
+func (p *Context) fileDiff(
+	name string, oldText string, newText string,
+) string {
+	if oldText == newText {
+		return ""
+	}
+
+	ret := ""
+	if len(oldText) > maxDiffSize || len(newText) > maxDiffSize {
+		ret = fmt.Sprintf(
+			"diff of %s is skipped: larger than %d bytes\n", name, maxDiffSize,
+		)
+	} else if strings.Contains(oldText+newText, "\x00") {
+		ret = fmt.Sprintf("Binary files %s differ\n", name)
+	} else if strings.Contains(oldText+newText, "PRIVATE KEY-----") {
+		ret = fmt.Sprintf("diff of %s is hidden: it has a private key\n", name)
+	} else {
+		ret = MaskSecrets(
+			UnifiedDiff(name, name, oldText, newText), p.diffSecrets(),
+		)
+	}
+
+	p.addDiff(ret)
+	return ret
+}
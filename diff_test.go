@@ -0,0 +1,105 @@
+package dbot
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	testCases := []struct {
+		a       string
+		b       string
+		changes int
+	}{
+		{"", "", 0},
+		{"a b c", "a b c", 0},
+		{"", "a b", 2},
+		{"a b", "", 2},
+		{"a b c", "a x c", 2},
+		{"a b c a b b a", "c b a b a c", 5},
+		{"x a b c", "a b c y", 2},
+	}
+
+	for _, it := range testCases {
+		a, b := strings.Fields(it.a), strings.Fields(it.b)
+		ops := diffLines(a, b)
+
+		// The edit script must turn a into b with the fewest changes
+		oldLines, newLines, changes := []string{}, []string{}, 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				oldLines = append(oldLines, op.line)
+			}
+			if op.kind != '-' {
+				newLines = append(newLines, op.line)
+			}
+			if op.kind != ' ' {
+				changes++
+			}
+		}
+
+		if fmt.Sprint(oldLines) != fmt.Sprint(a) ||
+			fmt.Sprint(newLines) != fmt.Sprint(b) || changes != it.changes {
+			t.Errorf(
+				"diffLines(%q, %q) has %d changes: %q -> %q, want %d",
+				it.a, it.b, changes, oldLines, newLines, it.changes,
+			)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	fnLines := func(from int, to int, fn func(i int) string) string {
+		sb := &strings.Builder{}
+		for i := from; i <= to; i++ {
+			sb.WriteString(fn(i) + "\n")
+		}
+		return sb.String()
+	}
+	oldNumbers := fnLines(1, 20, func(i int) string {
+		return fmt.Sprint(i)
+	})
+	newNumbers := fnLines(1, 20, func(i int) string {
+		if i == 1 {
+			return "one"
+		} else if i == 20 {
+			return "twenty"
+		}
+		return fmt.Sprint(i)
+	})
+
+	testCases := []struct {
+		old  string
+		new  string
+		want string
+	}{
+		{"a\n", "a\n", ""},
+		{
+			"a\nb\nc\n", "a\nx\nc\n",
+			"--- f\n+++ f\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{"", "a\n", "--- f\n+++ f\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "--- f\n+++ f\n@@ -1 +0,0 @@\n-a\n"},
+		{
+			"a\nb", "a\nc",
+			"--- f\n+++ f\n@@ -1,2 +1,2 @@\n a\n" +
+				"-b\n\\ No newline at end of file\n" +
+				"+c\n\\ No newline at end of file\n",
+		},
+		{
+			oldNumbers, newNumbers,
+			"--- f\n+++ f\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -17,4 +17,4 @@\n 17\n 18\n 19\n-20\n+twenty\n",
+		},
+	}
+
+	for _, it := range testCases {
+		if got := UnifiedDiff("f", "f", it.old, it.new); got != it.want {
+			t.Errorf(
+				"UnifiedDiff(%q, %q) = %q, want %q", it.old, it.new, got, it.want,
+			)
+		}
+	}
+}
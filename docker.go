@@ -0,0 +1,96 @@
+package dbot
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// DockerRunner runs the commands in a docker container with "docker exec"
+type DockerRunner struct {
+	docker    string
+	container string
+	user      string
+
+	sync.Mutex
+}
+
+// NewDockerRunner creates a DockerRunner. docker is the path of the docker
+// binary, and user is the user in the container, it can be empty.
+func NewDockerRunner(
+	ctx *Context,
+	docker string,
+	container string,
+	user string,
+) *DockerRunner {
+	ret := &DockerRunner{
+		docker:    docker,
+		container: container,
+		user:      user,
+	}
+
+	// Check if the container is running
+	stdout := &strings.Builder{}
+	if e := RunExecCommand(exec.Command(
+		docker, "inspect", "-f", "{{.State.Running}}", container,
+	), nil, stdout); e != nil {
+		ctx.LogError(e.Error())
+		return nil
+	} else if strings.TrimSpace(stdout.String()) != "true" {
+		ctx.LogError("container \"%s\" is not running", container)
+		return nil
+	}
+
+	return ret
+}
+
+func (p *DockerRunner) Name() string {
+	return fmt.Sprintf("docker:%s", p.container)
+}
+
+// execArgs returns the arguments of docker to run script in the container
+func (p *DockerRunner) execArgs(tty bool, term string, script string) []string {
+	ret := []string{"exec", "-i"}
+
+	if tty {
+		ret = append(ret, "-t", "-e", "TERM="+term)
+	}
+
+	if p.user != "" {
+		ret = append(ret, "-u", p.user)
+	}
+
+	return append(ret, p.container, "/bin/sh", "-c", script)
+}
+
+func (p *DockerRunner) Run(ctx *Context) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if strings.TrimSpace(ctx.runCmd.Exec) == "" {
+		ctx.LogError("the command is empty")
+		return false
+	}
+
+	// docker needs a terminal to allocate the tty in the container, it is
+	// provided by ExecRunnerCommand
+	execCommand := exec.Command(p.docker, p.execArgs(
+		ctx.runCmd.Tty, ctx.runCmd.TtyTerm, ctx.runCmd.ShellScript(),
+	)...)
+	execCommand.Env = os.Environ()
+
+	return ExecRunnerCommand(ctx, execCommand)
+}
+
+func (p *DockerRunner) OpenFS(ctx *Context) RunnerFS {
+	return NewExecFS(func(script string, stdin io.Reader, stdout io.Writer) error {
+		return RunExecCommand(
+			exec.Command(p.docker, p.execArgs(false, "", script)...),
+			stdin,
+			stdout,
+		)
+	})
+}
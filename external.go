@@ -0,0 +1,180 @@
+package dbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// externalActionPrefix is the prefix of the executables of the external
+// actions, the tag "name" is run by "dbot-action-name"
+const externalActionPrefix = "dbot-action-"
+
+var externalTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ExternalActionRequest is written to the stdin of the external action as
+// JSON. Check is true in check mode, only the check_safe commands are run
+// in it.
+type ExternalActionRequest struct {
+	Tag       string                 `json:"tag"`
+	Exec      string                 `json:"exec"`
+	Params    map[string]interface{} `json:"params"`
+	Src       string                 `json:"src,omitempty"`
+	Dest      string                 `json:"dest,omitempty"`
+	Register  string                 `json:"register,omitempty"`
+	Env       Env                    `json:"env"`
+	Runner    map[string]string      `json:"runner"`
+	Path      string                 `json:"path"`
+	ConfigDir string                 `json:"config_dir"`
+	Check     bool                   `json:"check"`
+}
+
+// ExternalActionResult is read from the stdout of the external action as
+// JSON. Outputs are saved as the registered results "<register>.<key>" if
+// the command has register.
+type ExternalActionResult struct {
+	OK       bool                   `json:"ok"`
+	Changed  bool                   `json:"changed"`
+	Outputs  map[string]interface{} `json:"outputs"`
+	Messages []string               `json:"messages"`
+}
+
+// ExternalAction is an Action implemented by an executable
+type ExternalAction struct {
+	path string
+}
+
+// FindExternalAction finds the executable "dbot-action-<tag>" in configDir
+// and then in PATH
+func FindExternalAction(tag string, configDir string) (*ExternalAction, bool) {
+	if !externalTagRegexp.MatchString(tag) {
+		return nil, false
+	}
+
+	name := externalActionPrefix + tag
+
+	if configDir != "" {
+		path := filepath.Join(configDir, name)
+		if info, e := os.Stat(path); e == nil &&
+			info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return &ExternalAction{path: path}, true
+		}
+	}
+
+	if path, e := exec.LookPath(name); e == nil {
+		return &ExternalAction{path: path}, true
+	}
+
+	return nil, false
+}
+
+func (p *Context) findExternalAction(tag string) (Action, bool) {
+	configDir := ""
+	if p.file != "" {
+		configDir = filepath.Dir(p.file)
+	}
+
+	if ret, ok := FindExternalAction(tag, configDir); ok {
+		return ret, true
+	}
+
+	return nil, false
+}
+
+// Params accepts any params, they are sent to the executable
+func (p *ExternalAction) Params() []*ActionParam {
+	return []*ActionParam{{Name: "*"}}
+}
+
+func (p *ExternalAction) Check(ctx *Context) bool {
+	return true
+}
+
+func (p *ExternalAction) Run(ctx *Context) bool {
+	runCmd := ctx.runCmd
+	configDir := ""
+	if ctx.file != "" {
+		configDir = filepath.Dir(ctx.file)
+	}
+
+	request, e := json.Marshal(&ExternalActionRequest{
+		Tag:       runCmd.Tag,
+		Exec:      runCmd.Exec,
+		Params:    runCmd.Params,
+		Src:       runCmd.Src,
+		Dest:      runCmd.Dest,
+		Register:  runCmd.Register,
+		Env:       runCmd.Env,
+		Runner:    runnerInfo(ctx.runners[0]),
+		Path:      ctx.path,
+		ConfigDir: configDir,
+		Check:     ctx.CheckMode(),
+	})
+	if e != nil {
+		ctx.LogError(e.Error())
+		return false
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	execCommand := exec.Command(p.path)
+	execCommand.Dir = configDir
+	execCommand.Stdin = bytes.NewReader(request)
+	execCommand.Stdout = stdout
+	execCommand.Stderr = stderr
+
+	e = execCommand.Run()
+	secrets := runCmd.Secrets()
+	errStr := MaskSecrets(strings.TrimSpace(stderr.String()), secrets)
+	if e != nil {
+		ctx.Log("", strings.TrimSpace(errStr+"\n"+e.Error()))
+		return false
+	}
+
+	result := &ExternalActionResult{}
+	if e := json.Unmarshal(stdout.Bytes(), result); e != nil {
+		ctx.Log("", strings.TrimSpace(fmt.Sprintf(
+			"%s\ninvalid result of \"%s\": %s", errStr, p.path, e.Error(),
+		)))
+		return false
+	}
+
+	// Save the outputs as the registered results
+	if runCmd.Register != "" {
+		runnerData := ctx.getRunnerData()
+		for key, value := range result.Outputs {
+			str, ok := value.(string)
+			if !ok {
+				v, _ := json.Marshal(value)
+				str = string(v)
+			}
+			runnerData.SetResult(
+				runCmd.Register+"."+key, MaskSecrets(str, secrets),
+			)
+		}
+	}
+
+	lines := make([]string, 0)
+	for _, it := range result.Messages {
+		lines = append(lines, MaskSecrets(it, secrets))
+	}
+
+	if !result.OK {
+		lines = append(lines, "failed: "+runCmd.Tag)
+		ctx.Log(errStr, strings.Join(lines, "\n"))
+		return false
+	} else if result.Changed {
+		ctx.SetStatus(StatusChanged)
+		lines = append(lines, "changed: "+runCmd.Tag)
+	} else {
+		lines = append(lines, "ok: "+runCmd.Tag)
+	}
+
+	ctx.Log(strings.Join(lines, "\n"), errStr)
+	return true
+}
@@ -0,0 +1,83 @@
+package dbot
+
+import (
+	"strings"
+)
+
+// factsScript prints the facts of the runner as "key=value" lines
+const factsScript = `
+echo "os=$(uname -s)"
+echo "kernel=$(uname -r)"
+echo "arch=$(uname -m)"
+echo "hostname=$(hostname 2>/dev/null || uname -n)"
+if [ -r /etc/os-release ]; then
+  . /etc/os-release
+  echo "distribution=$ID"
+  echo "distribution_version=$VERSION_ID"
+fi
+echo "cpus=$(getconf _NPROCESSORS_ONLN 2>/dev/null || nproc 2>/dev/null)"
+if [ -r /proc/meminfo ]; then
+  echo "memory_mb=$(awk '/^MemTotal:/ {print int($2 / 1024)}' /proc/meminfo)"
+else
+  echo "memory_mb=$(($(sysctl -n hw.memsize 2>/dev/null || echo 0) / 1048576))"
+fi
+ipv4=$( (hostname -I 2>/dev/null ||
+  ip -o -4 addr show 2>/dev/null | awk '{split($4, a, "/"); print a[1]}' ||
+  ifconfig 2>/dev/null | awk '/inet / {print $2}') |
+  tr ' ' '\n' | grep -v '^127\.' | grep -E '^[0-9.]+$' | tr '\n' ',')
+echo "ipv4=${ipv4%,}"
+echo "user=$(id -un)"
+echo "home=$HOME"
+`
+
+// parseFacts parses the "key=value" lines of the output of factsScript
+func parseFacts(output string) Env {
+	ret := Env{}
+
+	for _, line := range strings.Split(output, "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			if key := strings.TrimSpace(kv[0]); key != "" {
+				ret[key] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+
+	return ret
+}
+
+// gatherFacts collects the facts of runner once, they are kept in the
+// data of the runner
+func (p *Context) gatherFacts(runner Runner) bool {
+	runnerData := p.getRunnerDataByName(runner.Name())
+	runnerData.factsLock.Lock()
+	defer runnerData.factsLock.Unlock()
+
+	if len(runnerData.GetFacts()) > 0 {
+		return true
+	}
+
+	// The facts are gathered as a step of the runner, so that the runner
+	// is reported as unreachable or failed if it fails
+	ctx := p.Clone("%s.gather_facts", p.path)
+	ctx.runCmd = &Command{Tag: "gather_facts"}
+	ctx.runners = []Runner{runner}
+
+	return ctx.runStep(func() bool {
+		fs := runner.OpenFS(ctx)
+		if fs == nil {
+			return false
+		}
+		defer func() {
+			_ = fs.Close()
+		}()
+
+		output, e := fs.Output(factsScript)
+		if e != nil {
+			ctx.LogError("could not gather facts: %s", e.Error())
+			return false
+		}
+
+		runnerData.SetFacts(parseFacts(output))
+		return true
+	})
+}
@@ -0,0 +1,673 @@
+package dbot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// runCopy copies the local file or directory runCmd.Src to runCmd.Dest on
+// the runner. If Src is a directory, its content is copied into Dest.
+// The files whose content, mode and owner are unchanged are skipped.
+// If runCmd.Content is set, it is written to Dest instead.
+func (p *Context) runCopy() bool {
+	fs := p.runners[0].OpenFS(p)
+	if fs == nil {
+		return false
+	}
+	defer func() {
+		_ = fs.Close()
+	}()
+
+	if p.runCmd.Content != "" {
+		return p.putContent(fs, p.runCmd.Dest, []byte(p.runCmd.Content))
+	}
+
+	src := p.getLocalPath(p.runCmd.Src)
+	dest := p.runCmd.Dest
+	srcInfo, e := os.Stat(src)
+	if e != nil {
+		p.LogError(e.Error())
+		return false
+	}
+
+	changes := make([]string, 0)
+	fnCopy := func(srcPath string, destPath string, mode os.FileMode) error {
+		if changed, diff, e := p.copyFile(
+			fs, srcPath, destPath, mode,
+		); e != nil {
+			return e
+		} else if changed && diff != "" {
+			p.SetStatus(StatusChanged)
+			changes = append(
+				changes, "changed: "+destPath+"\n"+strings.TrimSpace(diff),
+			)
+		} else if changed {
+			p.SetStatus(StatusChanged)
+			changes = append(changes, "changed: "+destPath)
+		} else {
+			changes = append(changes, "ok: "+destPath)
+		}
+		return nil
+	}
+
+	if srcInfo.IsDir() {
+		e = filepath.Walk(src, func(
+			srcPath string, info os.FileInfo, e error,
+		) error {
+			if e != nil {
+				return e
+			}
+
+			rel, e := filepath.Rel(src, srcPath)
+			if e != nil {
+				return e
+			}
+			destPath := path.Join(dest, filepath.ToSlash(rel))
+
+			if info.IsDir() && p.CheckMode() {
+				return nil
+			} else if info.IsDir() {
+				return fs.MkdirAll(destPath, info.Mode().Perm())
+			} else if info.Mode().IsRegular() {
+				return fnCopy(srcPath, destPath, info.Mode().Perm())
+			} else {
+				return nil
+			}
+		})
+	} else {
+		// If dest is a directory, copy the file into it
+		if info, err := fs.Stat(dest); strings.HasSuffix(dest, "/") ||
+			(err == nil && info.IsDir()) {
+			dest = path.Join(dest, filepath.Base(src))
+		}
+
+		e = fnCopy(src, dest, srcInfo.Mode().Perm())
+	}
+
+	if e != nil {
+		p.Log(strings.Join(changes, "\n"), e.Error())
+		return false
+	}
+
+	p.LogInfo(strings.Join(changes, "\n"))
+	return true
+}
+
+// copyFile copies the local file src to dest with fs, and reports whether
+// dest has been changed. The diff is returned if it is enabled.
+func (p *Context) copyFile(
+	fs RunnerFS, src string, dest string, srcMode os.FileMode,
+) (bool, string, error) {
+	data, e := ioutil.ReadFile(src)
+	if e != nil {
+		return false, "", e
+	}
+
+	return p.writeFileWithDiff(fs, dest, data, srcMode)
+}
+
+// writeFileWithDiff writes data to dest like writeFile, and returns the
+// diff from the remote content if the diff is enabled
+func (p *Context) writeFileWithDiff(
+	fs RunnerFS, dest string, data []byte, defMode os.FileMode,
+) (bool, string, error) {
+	oldContent := ""
+	if p.showDiff() {
+		v, e := readRemoteFile(fs, dest)
+		if e != nil {
+			return false, "", e
+		}
+		oldContent = v
+	}
+
+	changed, e := p.writeFile(fs, dest, data, defMode)
+	if e != nil || !changed || !p.showDiff() {
+		return changed, "", e
+	}
+
+	return true, p.fileDiff(dest, oldContent, string(data)), nil
+}
+
+// readRemoteFile returns the content of the file path with fs, it is empty
+// if the file does not exist
+func readRemoteFile(fs RunnerFS, path string) (string, error) {
+	info, e := fs.Stat(path)
+	if os.IsNotExist(e) || (e == nil && info.IsDir()) {
+		return "", nil
+	} else if e != nil {
+		return "", e
+	}
+
+	data, e := fs.ReadFile(path)
+	if e != nil {
+		return "", e
+	}
+	return string(data), nil
+}
+
+// writeFile writes data to dest with fs if the content is different, and
+// applies runCmd.Mode and runCmd.Owner. It reports whether dest has been
+// changed. In check mode, it only reports whether dest would be changed.
+func (p *Context) writeFile(
+	fs RunnerFS, dest string, data []byte, defMode os.FileMode,
+) (bool, error) {
+	mode, e := p.runCmd.FileMode(defMode)
+	if e != nil {
+		return false, e
+	}
+
+	changed := false
+	info, e := fs.Stat(dest)
+
+	if e != nil && !os.IsNotExist(e) {
+		return false, e
+	} else if e == nil && info.IsDir() {
+		return false, &os.PathError{
+			Op: "copy", Path: dest, Err: os.ErrExist,
+		}
+	} else if sum, e := fs.Checksum(dest); e != nil || sum != Checksum(data) {
+		if p.CheckMode() {
+			changed = true
+		} else if e := fs.MkdirAll(path.Dir(dest), 0755); e != nil {
+			return false, e
+		} else if e := fs.WriteFile(dest, data, mode); e != nil {
+			return false, e
+		} else {
+			changed = true
+		}
+	} else if info.Mode().Perm() != mode.Perm() {
+		if !p.CheckMode() {
+			if e := fs.Chmod(dest, mode); e != nil {
+				return false, e
+			}
+		}
+		changed = true
+	}
+
+	// In check mode, dest may not exist if it is changed
+	if owner := p.runCmd.Owner; owner != "" && !(changed && p.CheckMode()) {
+		if current, e := fs.Owner(dest); e != nil {
+			return false, e
+		} else if !IsOwner(current, owner) {
+			if !p.CheckMode() {
+				if e := fs.Chown(dest, owner); e != nil {
+					return false, e
+				}
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// runFetch downloads the file or directory runCmd.Src on the runner into
+// the local directory runCmd.Dest. The files are put into a sub directory
+// named by the runner, e.g. out/user@host:22/ca.pem
+func (p *Context) runFetch() bool {
+	fs := p.runners[0].OpenFS(p)
+	if fs == nil {
+		return false
+	}
+	defer func() {
+		_ = fs.Close()
+	}()
+
+	src := p.runCmd.Src
+	destRoot := filepath.Join(
+		p.getLocalPath(p.runCmd.Dest), p.runners[0].Name(),
+	)
+
+	srcInfo, e := fs.Stat(src)
+	if os.IsNotExist(e) && !p.runCmd.FailOnMissing {
+		p.SetStatus(StatusSkipped)
+		p.LogInfo("skipped: %s does not exist", src)
+		return true
+	} else if os.IsNotExist(e) {
+		p.LogError("\"%s\" does not exist", src)
+		return false
+	} else if e != nil {
+		p.LogError(e.Error())
+		return false
+	}
+
+	changes := make([]string, 0)
+	var fnFetch func(srcPath string, destPath string, info os.FileInfo) error
+	fnFetch = func(srcPath string, destPath string, info os.FileInfo) error {
+		if info.IsDir() {
+			if !p.CheckMode() {
+				if e := os.MkdirAll(destPath, 0755); e != nil {
+					return e
+				}
+			}
+
+			children, e := fs.ReadDir(srcPath)
+			if e != nil {
+				return e
+			}
+
+			for _, child := range children {
+				if e := fnFetch(
+					path.Join(srcPath, child.Name()),
+					filepath.Join(destPath, child.Name()),
+					child,
+				); e != nil {
+					return e
+				}
+			}
+
+			return nil
+		} else if !info.Mode().IsRegular() {
+			return nil
+		} else if changed, e := fetchFile(
+			fs, srcPath, destPath, p.CheckMode(),
+		); e != nil {
+			return e
+		} else if changed {
+			p.SetStatus(StatusChanged)
+			changes = append(changes, "changed: "+destPath)
+			return nil
+		} else {
+			changes = append(changes, "ok: "+destPath)
+			return nil
+		}
+	}
+
+	if e := fnFetch(
+		src, filepath.Join(destRoot, path.Base(src)), srcInfo,
+	); e != nil {
+		p.Log(strings.Join(changes, "\n"), e.Error())
+		return false
+	}
+
+	p.LogInfo(strings.Join(changes, "\n"))
+	return true
+}
+
+// fetchFile downloads src with fs to the local file dest, and reports
+// whether dest has been changed. If check is true, dest is not written.
+func fetchFile(
+	fs RunnerFS, src string, dest string, check bool,
+) (bool, error) {
+	data, e := fs.ReadFile(src)
+	if e != nil {
+		return false, e
+	}
+
+	// Verify the content we received
+	sum, e := fs.Checksum(src)
+	if e != nil {
+		return false, e
+	} else if sum != Checksum(data) {
+		return false, fmt.Errorf("checksum of \"%s\" mismatch", src)
+	}
+
+	local := &LocalFS{}
+	if v, e := local.Checksum(dest); e == nil && v == sum {
+		return false, nil
+	} else if check {
+		return true, nil
+	} else if e := os.MkdirAll(filepath.Dir(dest), 0755); e != nil {
+		return false, e
+	} else if e := local.WriteFile(dest, data, 0644); e != nil {
+		return false, e
+	} else {
+		return true, nil
+	}
+}
+
+// runTemplate renders the local template runCmd.Src with Go text/template,
+// and writes the result to runCmd.Dest on the runner. The template can
+// access .Env, .Results (registered results) and .Facts of the runner.
+func (p *Context) runTemplate() bool {
+	runnerData := p.getRunnerData()
+	src := p.getLocalPath(p.runCmd.Src)
+	dest := p.runCmd.Dest
+	buffer := &bytes.Buffer{}
+
+	if tpl, e := template.New(filepath.Base(src)).
+		Option("missingkey=error").
+		ParseFiles(src); e != nil {
+		p.LogError(e.Error())
+		return false
+	} else if e := tpl.Execute(buffer, map[string]interface{}{
+		"Env":     p.runCmd.Env,
+		"Results": runnerData.GetResults(),
+		"Facts":   runnerData.GetFacts(),
+	}); e != nil {
+		p.LogError(e.Error())
+		return false
+	}
+
+	fs := p.runners[0].OpenFS(p)
+	if fs == nil {
+		return false
+	}
+	defer func() {
+		_ = fs.Close()
+	}()
+
+	return p.putContent(fs, dest, buffer.Bytes())
+}
+
+// putContent writes data to dest with fs, and logs whether dest has been
+// changed with the diff
+func (p *Context) putContent(fs RunnerFS, dest string, data []byte) bool {
+	changed, diff, e := p.writeFileWithDiff(fs, dest, data, 0644)
+	if e != nil {
+		p.LogError(e.Error())
+		return false
+	}
+
+	if !changed {
+		p.LogInfo("ok: %s", dest)
+		return true
+	}
+
+	p.SetStatus(StatusChanged)
+	if diff != "" {
+		p.LogInfo("changed: %s\n%s", dest, diff)
+	} else {
+		p.LogInfo("changed: %s", dest)
+	}
+
+	return true
+}
+
+type syncItem struct {
+	isDir bool
+	mode  os.FileMode
+	size  int64
+	mtime time.Time
+}
+
+// isExcluded reports whether the relative path rel matches any of the
+// exclude patterns. A pattern matches either the whole path or the base name
+func isExcluded(rel string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		} else if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runSync synchronises the local directory runCmd.Src to the directory
+// runCmd.Dest on the runner. Only the different files are transferred, and
+// the extraneous files on the runner are removed if runCmd.Delete is true.
+func (p *Context) runSync() bool {
+	// If src is not a directory, no files would be synchronised, and all
+	// the files in dest would be removed
+	src := p.getLocalPath(p.runCmd.Src)
+	if info, e := os.Stat(src); e != nil {
+		p.Clone("%s.src", p.path).LogError(e.Error())
+		return false
+	} else if !info.IsDir() {
+		p.Clone("%s.src", p.path).LogError(
+			"src \"%s\" is not a directory", p.runCmd.Src,
+		)
+		return false
+	}
+
+	fs := p.runners[0].OpenFS(p)
+	if fs == nil {
+		return false
+	}
+	defer func() {
+		_ = fs.Close()
+	}()
+
+	dest := p.runCmd.Dest
+	exclude := p.runCmd.Exclude
+
+	// Collect the local files
+	localItems := map[string]*syncItem{}
+	if e := filepath.Walk(src, func(
+		srcPath string, info os.FileInfo, e error,
+	) error {
+		if e != nil {
+			return e
+		}
+
+		rel, e := filepath.Rel(src, srcPath)
+		if e != nil || rel == "." {
+			return e
+		}
+
+		if rel = filepath.ToSlash(rel); isExcluded(rel, exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() || info.Mode().IsRegular() {
+			localItems[rel] = &syncItem{
+				isDir: info.IsDir(),
+				mode:  info.Mode().Perm(),
+				size:  info.Size(),
+				mtime: info.ModTime(),
+			}
+		}
+		return nil
+	}); e != nil {
+		p.LogError(e.Error())
+		return false
+	}
+
+	// In check mode, the changes are counted but not applied
+	fnApply := func(fn func() error) error {
+		if p.CheckMode() {
+			return nil
+		}
+		return fn()
+	}
+
+	// Collect the remote files
+	remoteItems := map[string]*syncItem{}
+	var fnWalkRemote func(rel string) error
+	fnWalkRemote = func(rel string) error {
+		children, e := fs.ReadDir(path.Join(dest, rel))
+		if e != nil {
+			return e
+		}
+
+		for _, child := range children {
+			childRel := path.Join(rel, child.Name())
+			if isExcluded(childRel, exclude) {
+				continue
+			}
+
+			remoteItems[childRel] = &syncItem{
+				isDir: child.IsDir(),
+				mode:  child.Mode().Perm(),
+				size:  child.Size(),
+				mtime: child.ModTime(),
+			}
+
+			if child.IsDir() {
+				if e := fnWalkRemote(childRel); e != nil {
+					return e
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if info, e := fs.Stat(dest); e != nil && !os.IsNotExist(e) {
+		p.LogError(e.Error())
+		return false
+	} else if e == nil && !info.IsDir() {
+		p.LogError("\"%s\" is not a directory", dest)
+		return false
+	} else if e == nil {
+		if e := fnWalkRemote(""); e != nil {
+			p.LogError(e.Error())
+			return false
+		}
+	} else if e := fnApply(func() error {
+		return fs.MkdirAll(dest, 0755)
+	}); e != nil {
+		p.LogError(e.Error())
+		return false
+	}
+
+	// Sort the paths so that the parent directories are created first
+	localPaths := make([]string, 0, len(localItems))
+	for rel := range localItems {
+		localPaths = append(localPaths, rel)
+	}
+	sort.Strings(localPaths)
+
+	changes := make([]string, 0)
+	created, updated, deleted, unchanged := 0, 0, 0, 0
+
+	fnSync := func(rel string) error {
+		local := localItems[rel]
+		remote := remoteItems[rel]
+		localPath := filepath.Join(src, filepath.FromSlash(rel))
+		remotePath := path.Join(dest, rel)
+
+		// Remove the remote item if the type is different
+		if remote != nil && remote.isDir != local.isDir {
+			if e := fnApply(func() error {
+				return fs.Remove(remotePath)
+			}); e != nil {
+				return e
+			}
+			remote = nil
+		}
+
+		if local.isDir {
+			if remote == nil {
+				created++
+				changes = append(changes, "created: "+rel+"/")
+				return fnApply(func() error {
+					return fs.MkdirAll(remotePath, local.mode)
+				})
+			} else if remote.mode != local.mode {
+				updated++
+				changes = append(changes, "updated: "+rel+"/")
+				return fnApply(func() error {
+					return fs.Chmod(remotePath, local.mode)
+				})
+			} else {
+				unchanged++
+				return nil
+			}
+		}
+
+		isDifferent := remote == nil || remote.size != local.size
+		if !isDifferent {
+			switch p.runCmd.Compare {
+			case "mtime":
+				isDifferent = remote.mtime.Unix() != local.mtime.Unix()
+			case "checksum":
+				localSum, e := (&LocalFS{}).Checksum(localPath)
+				if e != nil {
+					return e
+				}
+				remoteSum, e := fs.Checksum(remotePath)
+				if e != nil {
+					return e
+				}
+				isDifferent = localSum != remoteSum
+			}
+		}
+
+		if isDifferent {
+			if e := fnApply(func() error {
+				data, e := ioutil.ReadFile(localPath)
+				if e != nil {
+					return e
+				} else if e := fs.WriteFile(
+					remotePath, data, local.mode,
+				); e != nil {
+					return e
+				}
+				return fs.Chtimes(remotePath, local.mtime)
+			}); e != nil {
+				return e
+			} else if remote == nil {
+				created++
+				changes = append(changes, "created: "+rel)
+			} else {
+				updated++
+				changes = append(changes, "updated: "+rel)
+			}
+		} else if remote.mode != local.mode {
+			if e := fnApply(func() error {
+				return fs.Chmod(remotePath, local.mode)
+			}); e != nil {
+				return e
+			}
+			updated++
+			changes = append(changes, "updated: "+rel)
+		} else {
+			unchanged++
+		}
+
+		return nil
+	}
+
+	for _, rel := range localPaths {
+		if e := fnSync(rel); e != nil {
+			p.Log(strings.Join(changes, "\n"), e.Error())
+			return false
+		}
+	}
+
+	// Remove the extraneous remote items. The items whose parent directory
+	// is removed are skipped, because they have been removed together.
+	if p.runCmd.Delete {
+		remotePaths := make([]string, 0)
+		for rel := range remoteItems {
+			if _, ok := localItems[rel]; !ok {
+				remotePaths = append(remotePaths, rel)
+			}
+		}
+		sort.Strings(remotePaths)
+
+		removed := map[string]bool{}
+		for _, rel := range remotePaths {
+			if removed[path.Dir(rel)] {
+				removed[rel] = true
+				continue
+			}
+
+			if e := fnApply(func() error {
+				return fs.Remove(path.Join(dest, rel))
+			}); e != nil {
+				p.Log(strings.Join(changes, "\n"), e.Error())
+				return false
+			}
+
+			removed[rel] = true
+			deleted++
+			changes = append(changes, "deleted: "+rel)
+		}
+	}
+
+	if created+updated+deleted > 0 {
+		p.SetStatus(StatusChanged)
+	}
+
+	changes = append(changes, fmt.Sprintf(
+		"created: %d, updated: %d, deleted: %d, unchanged: %d",
+		created, updated, deleted, unchanged,
+	))
+	p.LogInfo(strings.Join(changes, "\n"))
+	return true
+}
@@ -0,0 +1,649 @@
+package dbot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// RunnerFS is the file system on the runner side
+type RunnerFS interface {
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	ReadFile(path string) ([]byte, error)
+	// WriteFile replaces the file atomically
+	WriteFile(path string, data []byte, mode os.FileMode) error
+	MkdirAll(path string, mode os.FileMode) error
+	Remove(path string) error
+	Chmod(path string, mode os.FileMode) error
+	Chtimes(path string, mtime time.Time) error
+	// Owner returns the owner of the file in the form of "user:group"
+	Owner(path string) (string, error)
+	// Chown changes the owner of the file, owner is "user" or "user:group"
+	Chown(path string, owner string) error
+	// Checksum returns the hex encoded sha256 of the file
+	Checksum(path string) (string, error)
+	// Output runs the shell script on the runner and returns its stdout.
+	// If the script exits with a non-zero code, the error is ExecError.
+	Output(script string) (string, error)
+	Close() error
+}
+
+// IsOwner reports whether owner ("user" or "user:group") matches
+// current ("user:group")
+func IsOwner(current string, owner string) bool {
+	if strings.Contains(owner, ":") {
+		return current == owner
+	}
+
+	return strings.SplitN(current, ":", 2)[0] == owner
+}
+
+// Checksum returns the hex encoded sha256 of data
+func Checksum(data []byte) string {
+	v := sha256.Sum256(data)
+	return hex.EncodeToString(v[:])
+}
+
+func checksumReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, e := io.Copy(h, r); e != nil {
+		return "", e
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func tempFilePath(path string) string {
+	return filepath.Join(
+		filepath.Dir(path),
+		fmt.Sprintf(
+			".%s.dbot-%d-%d",
+			filepath.Base(path), os.Getpid(), time.Now().UnixNano(),
+		),
+	)
+}
+
+// LocalFS is the RunnerFS of LocalRunner
+type LocalFS struct{}
+
+func (p *LocalFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (p *LocalFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(path)
+}
+
+func (p *LocalFS) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (p *LocalFS) WriteFile(
+	path string, data []byte, mode os.FileMode,
+) error {
+	tmpPath := tempFilePath(path)
+
+	if e := ioutil.WriteFile(tmpPath, data, mode); e != nil {
+		return e
+	} else if e := os.Chmod(tmpPath, mode); e != nil {
+		_ = os.Remove(tmpPath)
+		return e
+	} else if e := os.Rename(tmpPath, path); e != nil {
+		_ = os.Remove(tmpPath)
+		return e
+	} else {
+		return nil
+	}
+}
+
+// MkdirAll creates the directory path, and sets its mode explicitly, so
+// that the umask is not applied
+func (p *LocalFS) MkdirAll(path string, mode os.FileMode) error {
+	if info, e := os.Stat(path); e == nil && info.IsDir() {
+		return nil
+	} else if e := os.MkdirAll(path, mode); e != nil {
+		return e
+	} else {
+		return os.Chmod(path, mode)
+	}
+}
+
+func (p *LocalFS) Remove(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (p *LocalFS) Chmod(path string, mode os.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+func (p *LocalFS) Chtimes(path string, mtime time.Time) error {
+	return os.Chtimes(path, mtime, mtime)
+}
+
+func (p *LocalFS) Owner(path string) (string, error) {
+	info, e := os.Stat(path)
+	if e != nil {
+		return "", e
+	}
+
+	uid, gid, ok := fileOwnerID(info)
+	if !ok {
+		return "", fmt.Errorf("could not get the owner of \"%s\"", path)
+	}
+
+	userName := strconv.Itoa(uid)
+	if v, e := user.LookupId(userName); e == nil {
+		userName = v.Username
+	}
+
+	groupName := strconv.Itoa(gid)
+	if v, e := user.LookupGroupId(groupName); e == nil {
+		groupName = v.Name
+	}
+
+	return userName + ":" + groupName, nil
+}
+
+func (p *LocalFS) Chown(path string, owner string) error {
+	uid, gid := -1, -1
+	names := strings.SplitN(owner, ":", 2)
+
+	if v, e := user.Lookup(names[0]); e != nil {
+		return e
+	} else if uid, e = strconv.Atoi(v.Uid); e != nil {
+		return e
+	}
+
+	if len(names) == 2 {
+		if v, e := user.LookupGroup(names[1]); e != nil {
+			return e
+		} else if gid, e = strconv.Atoi(v.Gid); e != nil {
+			return e
+		}
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+func (p *LocalFS) Checksum(path string) (string, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return "", e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return checksumReader(f)
+}
+
+func (p *LocalFS) Output(script string) (string, error) {
+	stdout := &strings.Builder{}
+	e := RunExecCommand(exec.Command("/bin/sh", "-c", script), nil, stdout)
+	return stdout.String(), e
+}
+
+func (p *LocalFS) Close() error {
+	return nil
+}
+
+// SSHFS is the RunnerFS of SSHRunner. Files are transferred with SFTP,
+// and the remote commands run on the same ssh connection.
+type SSHFS struct {
+	client *ssh.Client
+	sftp   *sftp.Client
+}
+
+// NewSSHFS creates a SSHFS over the ssh connection
+func NewSSHFS(client *ssh.Client) (*SSHFS, error) {
+	sftpClient, e := sftp.NewClient(client)
+	if e != nil {
+		return nil, e
+	}
+
+	return &SSHFS{client: client, sftp: sftpClient}, nil
+}
+
+func (p *SSHFS) output(command string) (string, error) {
+	session, e := p.client.NewSession()
+	if e != nil {
+		return "", e
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+	ret, e := session.Output(command)
+	if v, ok := e.(*ssh.ExitError); ok {
+		return string(ret), &ExecError{
+			Code:    v.ExitStatus(),
+			Message: strings.TrimSpace(stderr.String()),
+		}
+	} else if e != nil && stderr.Len() > 0 {
+		return "", fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	}
+
+	return string(ret), e
+}
+
+func (p *SSHFS) Stat(path string) (os.FileInfo, error) {
+	return p.sftp.Stat(path)
+}
+
+func (p *SSHFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return p.sftp.ReadDir(path)
+}
+
+func (p *SSHFS) ReadFile(path string) ([]byte, error) {
+	f, e := p.sftp.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return ioutil.ReadAll(f)
+}
+
+func (p *SSHFS) WriteFile(path string, data []byte, mode os.FileMode) error {
+	tmpPath := tempFilePath(path)
+
+	f, e := p.sftp.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if e != nil {
+		return e
+	}
+
+	// The mode is set before the data is written, so that the data is not
+	// readable by the others while it is uploaded
+	if e := f.Chmod(mode); e != nil {
+		_ = f.Close()
+		_ = p.sftp.Remove(tmpPath)
+		return e
+	} else if _, e := f.Write(data); e != nil {
+		_ = f.Close()
+		_ = p.sftp.Remove(tmpPath)
+		return e
+	} else if e := f.Close(); e != nil {
+		_ = p.sftp.Remove(tmpPath)
+		return e
+	} else if e := p.sftp.PosixRename(tmpPath, path); e != nil {
+		_ = p.sftp.Remove(tmpPath)
+		return e
+	} else {
+		return nil
+	}
+}
+
+func (p *SSHFS) MkdirAll(path string, mode os.FileMode) error {
+	if info, e := p.sftp.Stat(path); e == nil && info.IsDir() {
+		return nil
+	} else if e := p.sftp.MkdirAll(path); e != nil {
+		return e
+	} else {
+		return p.sftp.Chmod(path, mode)
+	}
+}
+
+func (p *SSHFS) Remove(path string) error {
+	info, e := p.sftp.Lstat(path)
+	if e != nil {
+		return e
+	}
+
+	if info.IsDir() {
+		children, e := p.sftp.ReadDir(path)
+		if e != nil {
+			return e
+		}
+
+		for _, child := range children {
+			if e := p.Remove(p.sftp.Join(path, child.Name())); e != nil {
+				return e
+			}
+		}
+
+		return p.sftp.RemoveDirectory(path)
+	}
+
+	return p.sftp.Remove(path)
+}
+
+func (p *SSHFS) Chmod(path string, mode os.FileMode) error {
+	return p.sftp.Chmod(path, mode)
+}
+
+func (p *SSHFS) Chtimes(path string, mtime time.Time) error {
+	return p.sftp.Chtimes(path, mtime, mtime)
+}
+
+func (p *SSHFS) Owner(path string) (string, error) {
+	ret, e := p.output("stat -c %U:%G " + ShellQuote(path))
+	if e != nil {
+		return "", e
+	}
+
+	return strings.TrimSpace(ret), nil
+}
+
+func (p *SSHFS) Chown(path string, owner string) error {
+	_, e := p.output("chown " + ShellQuote(owner) + " " + ShellQuote(path))
+	return e
+}
+
+func (p *SSHFS) Checksum(path string) (string, error) {
+	// Let the remote compute the checksum if it can
+	if ret, e := p.output("sha256sum " + ShellQuote(path)); e == nil {
+		if fields := strings.Fields(ret); len(fields) > 0 {
+			return fields[0], nil
+		}
+	}
+
+	f, e := p.sftp.Open(path)
+	if e != nil {
+		return "", e
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return checksumReader(f)
+}
+
+func (p *SSHFS) Output(script string) (string, error) {
+	return p.output(script)
+}
+
+func (p *SSHFS) Close() error {
+	return p.sftp.Close()
+}
+
+// ExecError is returned by ExecFunc if the script exits with a non-zero code
+type ExecError struct {
+	Code    int
+	Message string
+}
+
+func (p *ExecError) Error() string {
+	if p.Message != "" {
+		return p.Message
+	}
+
+	return fmt.Sprintf("exit code %d", p.Code)
+}
+
+// ExecFunc runs the POSIX shell script on the runner with stdin, and writes
+// the output to stdout
+type ExecFunc func(script string, stdin io.Reader, stdout io.Writer) error
+
+// RunExecCommand runs the local process execCommand with stdin and stdout.
+// The error is converted to ExecError if the process exits with a
+// non-zero code.
+func RunExecCommand(
+	execCommand *exec.Cmd, stdin io.Reader, stdout io.Writer,
+) error {
+	stderr := &bytes.Buffer{}
+	execCommand.Stdin = stdin
+	execCommand.Stdout = stdout
+	execCommand.Stderr = stderr
+
+	e := execCommand.Run()
+	if v, ok := e.(*exec.ExitError); ok {
+		return &ExecError{
+			Code:    v.ExitCode(),
+			Message: strings.TrimSpace(stderr.String()),
+		}
+	}
+
+	return e
+}
+
+// execNotExistCode is the exit code of the scripts of ExecFS if the file
+// does not exist
+const execNotExistCode = 3
+
+type execFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (p *execFileInfo) Name() string       { return p.name }
+func (p *execFileInfo) Size() int64        { return p.size }
+func (p *execFileInfo) Mode() os.FileMode  { return p.mode }
+func (p *execFileInfo) ModTime() time.Time { return p.mtime }
+func (p *execFileInfo) IsDir() bool        { return p.mode.IsDir() }
+func (p *execFileInfo) Sys() interface{}   { return nil }
+
+// parseExecFileInfo parses the output of stat -c '%f|%s|%Y|%n'
+func parseExecFileInfo(line string) (*execFileInfo, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), "|", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected stat output \"%s\"", line)
+	}
+
+	rawMode, e := strconv.ParseUint(fields[0], 16, 32)
+	if e != nil {
+		return nil, e
+	}
+
+	size, e := strconv.ParseInt(fields[1], 10, 64)
+	if e != nil {
+		return nil, e
+	}
+
+	mtime, e := strconv.ParseInt(fields[2], 10, 64)
+	if e != nil {
+		return nil, e
+	}
+
+	mode := os.FileMode(rawMode & 0777)
+	switch rawMode & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0100000:
+	case 0120000:
+		mode |= os.ModeSymlink
+	default:
+		mode |= os.ModeIrregular
+	}
+
+	return &execFileInfo{
+		name:  path.Base(fields[3]),
+		size:  size,
+		mode:  mode,
+		mtime: time.Unix(mtime, 0),
+	}, nil
+}
+
+// ExecFS is the RunnerFS that works with the POSIX shell tools on the
+// runner, such as the runners of docker containers and kubernetes pods
+type ExecFS struct {
+	exec ExecFunc
+}
+
+// NewExecFS creates an ExecFS that runs the scripts with fn
+func NewExecFS(fn ExecFunc) *ExecFS {
+	return &ExecFS{exec: fn}
+}
+
+func (p *ExecFS) run(
+	filePath string, script string, stdin io.Reader,
+) (string, error) {
+	stdout := &bytes.Buffer{}
+	e := p.exec(
+		fmt.Sprintf(
+			"[ -e %s ] || [ -L %s ] || exit %d\n%s",
+			ShellQuote(filePath), ShellQuote(filePath), execNotExistCode,
+			script,
+		),
+		stdin,
+		stdout,
+	)
+
+	if v, ok := e.(*ExecError); ok && v.Code == execNotExistCode {
+		return "", &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+	} else if e != nil {
+		return "", e
+	} else {
+		return stdout.String(), nil
+	}
+}
+
+func (p *ExecFS) Stat(filePath string) (os.FileInfo, error) {
+	ret, e := p.run(
+		filePath, "stat -L -c '%f|%s|%Y|%n' "+ShellQuote(filePath), nil,
+	)
+	if e != nil {
+		return nil, e
+	}
+
+	return parseExecFileInfo(ret)
+}
+
+func (p *ExecFS) ReadDir(filePath string) ([]os.FileInfo, error) {
+	output, e := p.run(
+		filePath,
+		"find "+ShellQuote(filePath)+" -mindepth 1 -maxdepth 1 "+
+			"-exec stat -L -c '%f|%s|%Y|%n' {} +",
+		nil,
+	)
+	if e != nil {
+		return nil, e
+	}
+
+	ret := make([]os.FileInfo, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			info, e := parseExecFileInfo(line)
+			if e != nil {
+				return nil, e
+			}
+			ret = append(ret, info)
+		}
+	}
+
+	return ret, nil
+}
+
+func (p *ExecFS) ReadFile(filePath string) ([]byte, error) {
+	ret, e := p.run(filePath, "cat "+ShellQuote(filePath), nil)
+	return []byte(ret), e
+}
+
+func (p *ExecFS) WriteFile(
+	filePath string, data []byte, mode os.FileMode,
+) error {
+	// The temp file is created with umask 077, so that the data is not
+	// readable by the others before the mode is set
+	tmpPath := ShellQuote(tempFilePath(filePath))
+	return p.exec(
+		fmt.Sprintf(
+			"(umask 077 && cat > %s) && chmod %o %s && mv -f %s %s || "+
+				"{ rm -f %s; exit 1; }",
+			tmpPath, mode.Perm(), tmpPath, tmpPath, ShellQuote(filePath),
+			tmpPath,
+		),
+		bytes.NewReader(data),
+		ioutil.Discard,
+	)
+}
+
+// MkdirAll creates the directory filePath, and sets its mode explicitly
+// like SSHFS.MkdirAll
+func (p *ExecFS) MkdirAll(filePath string, mode os.FileMode) error {
+	quoted := ShellQuote(filePath)
+	return p.exec(
+		fmt.Sprintf(
+			"[ -d %s ] || { mkdir -p %s && chmod %o %s; }",
+			quoted, quoted, mode.Perm(), quoted,
+		),
+		nil,
+		ioutil.Discard,
+	)
+}
+
+func (p *ExecFS) Remove(filePath string) error {
+	_, e := p.run(filePath, "rm -rf "+ShellQuote(filePath), nil)
+	return e
+}
+
+func (p *ExecFS) Chmod(filePath string, mode os.FileMode) error {
+	_, e := p.run(
+		filePath,
+		fmt.Sprintf("chmod %o %s", mode.Perm(), ShellQuote(filePath)),
+		nil,
+	)
+	return e
+}
+
+func (p *ExecFS) Chtimes(filePath string, mtime time.Time) error {
+	_, e := p.run(
+		filePath,
+		fmt.Sprintf(
+			"TZ=UTC touch -m -t %s %s",
+			mtime.UTC().Format("200601021504.05"), ShellQuote(filePath),
+		),
+		nil,
+	)
+	return e
+}
+
+func (p *ExecFS) Owner(filePath string) (string, error) {
+	ret, e := p.run(filePath, "stat -c %U:%G "+ShellQuote(filePath), nil)
+	return strings.TrimSpace(ret), e
+}
+
+func (p *ExecFS) Chown(filePath string, owner string) error {
+	_, e := p.run(
+		filePath, "chown "+ShellQuote(owner)+" "+ShellQuote(filePath), nil,
+	)
+	return e
+}
+
+func (p *ExecFS) Checksum(filePath string) (string, error) {
+	ret, e := p.run(filePath, "sha256sum "+ShellQuote(filePath), nil)
+	if e == nil {
+		if fields := strings.Fields(ret); len(fields) > 0 {
+			return fields[0], nil
+		}
+	} else if os.IsNotExist(e) {
+		return "", e
+	}
+
+	// sha256sum is not available, so compute the checksum by ourselves
+	data, e := p.ReadFile(filePath)
+	if e != nil {
+		return "", e
+	}
+
+	return Checksum(data), nil
+}
+
+func (p *ExecFS) Output(script string) (string, error) {
+	stdout := &bytes.Buffer{}
+	e := p.exec(script, nil, stdout)
+	return stdout.String(), e
+}
+
+func (p *ExecFS) Close() error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package dbot
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileOwnerID(info os.FileInfo) (int, int, bool) {
+	if v, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(v.Uid), int(v.Gid), true
+	}
+
+	return 0, 0, false
+}
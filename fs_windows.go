@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package dbot
+
+import (
+	"os"
+)
+
+func fileOwnerID(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
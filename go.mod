@@ -3,9 +3,11 @@ module github.com/rpccloud/dbot
 go 1.16
 
 require (
+	github.com/creack/pty v1.1.18
 	github.com/fatih/color v1.12.0
 	github.com/ghodss/yaml v1.0.0
-	github.com/robertkrimen/otto v0.0.0-20210614181706-373ff5438452 // indirect
+	github.com/pkg/sftp v1.13.4
+	github.com/robertkrimen/otto v0.0.0-20210614181706-373ff5438452
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	gopkg.in/sourcemap.v1 v1.0.5 // indirect
@@ -0,0 +1,151 @@
+package dbot
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// guardResult is the result of a guard that runs on the runner
+type guardResult struct {
+	done   bool
+	stdout string
+	err    error
+}
+
+// guardPath returns the path of the guards creates and removes on the
+// runner, the relative path is relative to Cwd
+func (p *Context) guardPath(filePath string) string {
+	if path.IsAbs(filePath) || p.runCmd.Cwd == "" {
+		return filePath
+	}
+
+	return path.Join(p.runCmd.Cwd, filePath)
+}
+
+// checkGuards checks the guards creates, removes and unless on the runner.
+// It returns the reason if the command should be skipped. If the guards
+// could not be checked, the error is logged and ok is false.
+func (p *Context) checkGuards() (reason string, ok bool) {
+	runCmd := p.runCmd
+	if runCmd.Creates == "" && runCmd.Removes == "" && runCmd.Unless == "" {
+		return "", true
+	} else if runCmd.IsBecome() {
+		return p.checkBecomeGuards()
+	}
+
+	fs := p.runners[0].OpenFS(p)
+	if fs == nil {
+		return "", false
+	}
+	defer func() {
+		_ = fs.Close()
+	}()
+
+	if runCmd.Creates != "" {
+		filePath := p.guardPath(runCmd.Creates)
+		if _, e := fs.Stat(filePath); e == nil {
+			return filePath + " exists", true
+		} else if !os.IsNotExist(e) {
+			p.Clone("%s.creates", p.path).LogError(e.Error())
+			return "", false
+		}
+	}
+
+	if runCmd.Removes != "" {
+		filePath := p.guardPath(runCmd.Removes)
+		if _, e := fs.Stat(filePath); os.IsNotExist(e) {
+			return filePath + " does not exist", true
+		} else if e != nil {
+			p.Clone("%s.removes", p.path).LogError(e.Error())
+			return "", false
+		}
+	}
+
+	if runCmd.Unless != "" {
+		// Run the guard with the Env, Cwd and Shell of the command
+		unlessCmd := *runCmd
+		unlessCmd.Exec = runCmd.Unless
+
+		if _, e := fs.Output(unlessCmd.ShellScript()); e == nil {
+			return "unless succeeded", true
+		} else if _, ok := e.(*ExecError); !ok {
+			p.Clone("%s.unless", p.path).LogError(e.Error())
+			return "", false
+		}
+	}
+
+	return "", true
+}
+
+// checkBecomeGuards checks the guards of the command that becomes another
+// user. The guards run on the runner with the privilege escalation, so
+// that they can check the files that the login user can not access.
+func (p *Context) checkBecomeGuards() (reason string, ok bool) {
+	runCmd := p.runCmd
+
+	if runCmd.Creates != "" {
+		filePath := p.guardPath(runCmd.Creates)
+		if v, ok := p.runGuard("creates", testExists(filePath)); !ok {
+			return "", false
+		} else if v {
+			return filePath + " exists", true
+		}
+	}
+
+	if runCmd.Removes != "" {
+		filePath := p.guardPath(runCmd.Removes)
+		if v, ok := p.runGuard("removes", testExists(filePath)); !ok {
+			return "", false
+		} else if !v {
+			return filePath + " does not exist", true
+		}
+	}
+
+	if runCmd.Unless != "" {
+		if v, ok := p.runGuard("unless", runCmd.Unless); !ok {
+			return "", false
+		} else if v {
+			return "unless succeeded", true
+		}
+	}
+
+	return "", true
+}
+
+// testExists returns the script that tests whether the file exists
+func testExists(filePath string) string {
+	return fmt.Sprintf("[ -e %s ]", ShellQuote(filePath))
+}
+
+// runGuard runs the script of the guard name on the runner with the Env,
+// Cwd, Shell and become of the command. It returns whether the script
+// succeeds, ok is false if the script could not run.
+func (p *Context) runGuard(name string, script string) (ret bool, ok bool) {
+	guardCmd := *p.runCmd
+	guardCmd.Exec = script
+	guardCmd.Stdin = nil
+	guardCmd.Expect = nil
+
+	ctx := p.Clone("%s.%s", p.path, name)
+	ctx.runCmd = &guardCmd
+	ctx.guard = &guardResult{}
+	if ran := p.runners[0].Run(ctx); !ctx.guard.done {
+		// The runner has logged the error if it has failed
+		if ran {
+			ctx.LogError("could not get the result of the guard")
+		}
+		return false, false
+	} else if !strings.Contains(ctx.guard.stdout, BecomeMarker) {
+		// The script has not run, because the privilege escalation failed
+		e := ctx.guard.err
+		if e == nil {
+			e = fmt.Errorf("privilege escalation failed")
+		}
+		ctx.LogError(e.Error())
+		return false, false
+	}
+
+	return ctx.guard.err == nil, true
+}
@@ -0,0 +1,119 @@
+package dbot
+
+import (
+	"sync"
+)
+
+// flushHandlersTag is the tag of the command that runs the notified
+// handlers of the job immediately
+const flushHandlersTag = "flush_handlers"
+
+// handlerQueue keeps the notified handlers of a job, and the runners on
+// which they are notified
+type handlerQueue struct {
+	names   []string
+	runners map[string][]Runner
+	sync.Mutex
+}
+
+func newHandlerQueue() *handlerQueue {
+	return &handlerQueue{
+		names:   make([]string, 0),
+		runners: make(map[string][]Runner),
+	}
+}
+
+// add notifies the handler name on runner
+func (p *handlerQueue) add(name string, runner Runner) {
+	p.Lock()
+	defer p.Unlock()
+
+	list, ok := p.runners[name]
+	if !ok {
+		p.names = append(p.names, name)
+	}
+
+	for _, it := range list {
+		if it.Name() == runner.Name() {
+			return
+		}
+	}
+	p.runners[name] = append(list, runner)
+}
+
+// take returns the notified handlers in the order of their first
+// notification, and clears the queue
+func (p *handlerQueue) take() ([]string, map[string][]Runner) {
+	p.Lock()
+	defer p.Unlock()
+
+	names, runners := p.names, p.runners
+	p.names = make([]string, 0)
+	p.runners = make(map[string][]Runner)
+	return names, runners
+}
+
+// handlerContext returns the context of the nearest running job that has
+// the handler name, or nil if there is no such job
+func (p *Context) handlerContext(name string) *Context {
+	for ctx := p; ctx != nil; ctx = ctx.parent {
+		if ctx.handlers != nil && ctx.job != nil {
+			if _, ok := ctx.job.Handlers[name]; ok {
+				return ctx
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkNotify checks that the handlers in runCmd.Notify exist
+func (p *Context) checkNotify() bool {
+	for idx, name := range p.runCmd.Notify {
+		if p.handlerContext(name) == nil {
+			p.Clone("%s.notify[%d]", p.path, idx).LogError(
+				"could not find handler \"%s\"", name,
+			)
+			return false
+		}
+	}
+
+	return true
+}
+
+// notifyHandlers notifies the handlers in runCmd.Notify on the runner of
+// the context, it is called if the command has changed the runner
+func (p *Context) notifyHandlers() {
+	for _, name := range p.runCmd.Notify {
+		if ctx := p.handlerContext(name); ctx != nil {
+			ctx.handlers.add(name, p.runners[0])
+		}
+	}
+}
+
+// flushHandlers runs the notified handlers of the job. Each handler runs
+// once on the runners on which it has been notified. The handlers that
+// are notified by the handlers run after them.
+func (p *Context) flushHandlers() bool {
+	for {
+		names, runners := p.handlers.take()
+		if len(names) == 0 {
+			return true
+		}
+
+		for _, name := range names {
+			ctx := p.Clone("%s.handlers.%s", p.runCmd.Exec, name).
+				subContextOn(
+					p.job.Handlers[name], runners[name], 0, p.runnerVarsMap,
+				)
+
+			if ctx == nil {
+				return false
+			}
+
+			if !ctx.Run() {
+				return false
+			}
+		}
+	}
+}
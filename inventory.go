@@ -0,0 +1,422 @@
+package dbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+)
+
+var gInventoryLock sync.Mutex
+
+// Inventory defines the groups of the runners. The groups can contain
+// other groups by Children, and the variables of the groups and the hosts
+// are merged into the Env when the commands run on the host.
+type Inventory struct {
+	Groups map[string]*InventoryGroup
+	Hosts  map[string]*InventoryHost
+}
+
+// InventoryGroup is a group of the inventory. Hosts are the names of the
+// hosts, they can be ranges like "web[01:20].example.com".
+type InventoryGroup struct {
+	Hosts    []string
+	Children []string
+	Vars     Env
+}
+
+// InventoryHost is the settings of a host in the inventory. Host is the
+// name of the host by default, and Type is the runner type (default "ssh").
+type InventoryHost struct {
+	Type   string
+	Host   string
+	User   string
+	Port   string
+	Config map[string]string
+	Vars   Env
+}
+
+var hostRangeRegexp = regexp.MustCompile(
+	`\[([0-9]+|[a-zA-Z]):([0-9]+|[a-zA-Z])(?::([0-9]+))?\]`,
+)
+
+// ExpandHostPattern expands the ranges in the host pattern, for example
+// "web[01:03]" is expanded to "web01", "web02" and "web03", and "db-[a:c]"
+// is expanded to "db-a", "db-b" and "db-c". The step can be set by
+// "[1:9:2]".
+func ExpandHostPattern(pattern string) ([]string, error) {
+	loc := hostRangeRegexp.FindStringSubmatchIndex(pattern)
+	if loc == nil {
+		if strings.ContainsAny(pattern, "[]") {
+			return nil, fmt.Errorf("host pattern \"%s\" is invalid", pattern)
+		}
+		return []string{pattern}, nil
+	}
+
+	prefix := pattern[:loc[0]]
+	start := pattern[loc[2]:loc[3]]
+	end := pattern[loc[4]:loc[5]]
+	step := 1
+	if loc[6] >= 0 {
+		step, _ = strconv.Atoi(pattern[loc[6]:loc[7]])
+	}
+
+	if step <= 0 {
+		return nil, fmt.Errorf("host pattern \"%s\" is invalid", pattern)
+	}
+
+	items := make([]string, 0)
+	if startNum, e := strconv.Atoi(start); e == nil {
+		endNum, e := strconv.Atoi(end)
+		if e != nil || endNum < startNum {
+			return nil, fmt.Errorf("host pattern \"%s\" is invalid", pattern)
+		}
+
+		// Keep the leading zeros, such as "[01:20]"
+		format := "%d"
+		if len(start) > 1 && start[0] == '0' {
+			format = fmt.Sprintf("%%0%dd", len(start))
+		}
+
+		for i := startNum; i <= endNum; i += step {
+			items = append(items, fmt.Sprintf(format, i))
+		}
+	} else {
+		if len(end) != 1 || end[0] < start[0] ||
+			(end[0] >= '0' && end[0] <= '9') {
+			return nil, fmt.Errorf("host pattern \"%s\" is invalid", pattern)
+		}
+
+		for c := int(start[0]); c <= int(end[0]); c += step {
+			items = append(items, string(rune(c)))
+		}
+	}
+
+	// Expand the other ranges in the rest of the pattern
+	suffixes, e := ExpandHostPattern(pattern[loc[1]:])
+	if e != nil {
+		return nil, e
+	}
+
+	ret := make([]string, 0, len(items)*len(suffixes))
+	for _, item := range items {
+		for _, suffix := range suffixes {
+			ret = append(ret, prefix+item+suffix)
+		}
+	}
+
+	return ret, nil
+}
+
+// inventoryLoader resolves the groups of an inventory
+type inventoryLoader struct {
+	ctx       *Context
+	inventory *Inventory
+	env       Env
+	// groups keeps the resolved hosts of the groups
+	groups map[string][]string
+	// vars keeps the variables of the hosts
+	vars    map[string]Env
+	loading map[string]bool
+}
+
+// resolve returns the host names of the group, and merges the variables
+// of the group into the hosts. The variables of the child groups override
+// the variables of the parent groups.
+func (p *inventoryLoader) resolve(name string, parentVars Env) []string {
+	group, ok := p.inventory.Groups[name]
+	if !ok || group == nil {
+		p.ctx.LogError("could not find group \"%s\"", name)
+		return nil
+	}
+
+	if p.loading[name] {
+		p.ctx.LogError("group \"%s\" contains itself", name)
+		return nil
+	}
+	p.loading[name] = true
+	defer delete(p.loading, name)
+
+	groupVars := parentVars.Merge(p.env.ParseEnv(group.Vars))
+	ret := make([]string, 0)
+	exists := make(map[string]bool)
+	fnAdd := func(host string) {
+		if !exists[host] {
+			exists[host] = true
+			ret = append(ret, host)
+		}
+	}
+
+	for idx, it := range group.Hosts {
+		hosts, e := ExpandHostPattern(p.env.ParseString(it, "", true))
+		if e != nil {
+			p.ctx.Clone("%s.groups.%s.hosts[%d]", p.ctx.path, name, idx).
+				LogError(e.Error())
+			return nil
+		}
+
+		for _, host := range hosts {
+			p.vars[host] = p.vars[host].Merge(groupVars)
+			fnAdd(host)
+		}
+	}
+
+	for _, child := range group.Children {
+		hosts := p.resolve(p.env.ParseString(child, "", true), groupVars)
+		if hosts == nil {
+			return nil
+		}
+
+		for _, host := range hosts {
+			fnAdd(host)
+		}
+	}
+
+	p.groups[name] = ret
+	return ret
+}
+
+// loadInventory loads the inventory file, its groups are added to the
+// runner groups of the context
+func (p *Context) loadInventory(file string) bool {
+	inventory := &Inventory{}
+	absFile, ok := p.loadConfig(file, inventory)
+	if !ok {
+		return false
+	}
+
+	groups, _ := p.Clone("%s", absFile).resolveInventory(inventory)
+	if groups == nil {
+		return false
+	}
+
+	for name, ids := range groups {
+		p.runnerGroupMap[name] = ids
+	}
+
+	return true
+}
+
+// loadInventoryGroup loads the inventory by kind, and returns the runners
+// of the group name. If name is empty, all the runners are returned.
+func (p *Context) loadInventoryGroup(
+	kind string, file string, name string, env Env,
+) []string {
+	inventory := p.getInventory(kind, file, env)
+	if inventory == nil {
+		return nil
+	}
+
+	groups, all := p.resolveInventory(inventory)
+	if groups == nil {
+		return nil
+	} else if name == "" {
+		return all
+	} else if ret, ok := groups[name]; ok {
+		return ret
+	}
+
+	p.LogError("could not find group \"%s\" in the inventory", name)
+	return nil
+}
+
+// getInventory returns the inventory loaded by kind. It is cached during
+// the run, so the executables and the scripts run only once.
+func (p *Context) getInventory(kind string, file string, env Env) *Inventory {
+	path := p.getLocalPath(file)
+	if kind == "exec" && !IsFile(path) {
+		// Find the executable in PATH
+		if v, e := exec.LookPath(file); e == nil {
+			path = v
+		}
+	}
+
+	envJSON, _ := json.Marshal(env)
+	key := kind + "\n" + path + "\n" + string(envJSON)
+
+	gInventoryLock.Lock()
+	defer gInventoryLock.Unlock()
+
+	if ret, ok := p.inventoryMap[key]; ok {
+		return ret
+	}
+
+	ret := &Inventory{}
+	switch kind {
+	case "inventory":
+		if _, ok := p.loadConfig(path, ret); !ok {
+			return nil
+		}
+	case "exec":
+		stdout := &bytes.Buffer{}
+		execCommand := exec.Command(path)
+		execCommand.Dir = filepath.Dir(p.file)
+		execCommand.Env = os.Environ()
+		for key, value := range env {
+			execCommand.Env = append(execCommand.Env, key+"="+value)
+		}
+
+		if e := RunExecCommand(execCommand, nil, stdout); e != nil {
+			p.LogError("%s: %s", path, e.Error())
+			return nil
+		} else if e := json.Unmarshal(stdout.Bytes(), ret); e != nil {
+			p.LogError("invalid inventory of \"%s\": %s", path, e.Error())
+			return nil
+		}
+	case "script":
+		if e := runInventoryScript(path, env, ret); e != nil {
+			p.LogError("%s: %s", path, e.Error())
+			return nil
+		}
+	default:
+		p.LogError("unsupported inventory type \"%s\"", kind)
+		return nil
+	}
+
+	p.inventoryMap[key] = ret
+	return ret
+}
+
+// runInventoryScript runs the JavaScript file, the value of the script is
+// the inventory, it can be an object or a JSON string. env can be used by
+// the variable "env" in the script.
+func runInventoryScript(path string, env Env, inventory *Inventory) error {
+	src, e := ioutil.ReadFile(path)
+	if e != nil {
+		return e
+	}
+
+	vm := otto.New()
+	if e := vm.Set("env", map[string]string(env)); e != nil {
+		return e
+	}
+
+	value, e := vm.Run(string(src))
+	if e != nil {
+		return e
+	}
+
+	data := []byte(value.String())
+	if !value.IsString() {
+		v, e := value.Export()
+		if e != nil {
+			return e
+		}
+
+		if data, e = json.Marshal(v); e != nil {
+			return e
+		}
+	}
+
+	if e := json.Unmarshal(data, inventory); e != nil {
+		return fmt.Errorf("invalid inventory: %s", e.Error())
+	}
+
+	return nil
+}
+
+// resolveInventory creates the runners of the inventory. It returns the
+// runners of the groups and all the runners.
+func (p *Context) resolveInventory(
+	inventory *Inventory,
+) (map[string][]string, []string) {
+	loader := &inventoryLoader{
+		ctx:       p,
+		inventory: inventory,
+		env:       p.getRootEnv(),
+		groups:    map[string][]string{},
+		vars:      map[string]Env{},
+		loading:   map[string]bool{},
+	}
+
+	names := make([]string, 0, len(inventory.Groups))
+	for name := range inventory.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if loader.resolve(name, Env{}) == nil {
+			return nil, nil
+		}
+	}
+
+	// The hosts that are not in any groups
+	hosts := make([]string, 0)
+	for host := range inventory.Hosts {
+		if _, ok := loader.vars[host]; !ok {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	// Create the runners of the hosts
+	runnerIDs := make(map[string]string)
+	all := make([]string, 0)
+	fnLoad := func(host string) (string, bool) {
+		if id, ok := runnerIDs[host]; ok {
+			return id, true
+		}
+
+		it := inventory.Hosts[host]
+		if it == nil {
+			it = &InventoryHost{}
+		}
+
+		// The host variables override the group variables
+		remote := &Remote{
+			Type:   it.Type,
+			Host:   it.Host,
+			User:   it.User,
+			Port:   it.Port,
+			Config: it.Config,
+			Vars:   loader.vars[host].Merge(it.Vars),
+		}
+		if remote.Host == "" {
+			remote.Host = host
+		}
+
+		list := p.Clone("%s.hosts.%s", p.path, host).
+			loadRemoteGroup([]*Remote{remote}, loader.env)
+		if list == nil {
+			return "", false
+		}
+
+		runnerIDs[host] = list[0]
+		all = append(all, list[0])
+		return list[0], true
+	}
+
+	groups := make(map[string][]string)
+	for _, name := range names {
+		ids := make([]string, 0)
+
+		for _, host := range loader.groups[name] {
+			id, ok := fnLoad(host)
+			if !ok {
+				return nil, nil
+			}
+			ids = append(ids, id)
+		}
+
+		groups[name] = ids
+	}
+
+	for _, host := range hosts {
+		if _, ok := fnLoad(host); !ok {
+			return nil, nil
+		}
+	}
+
+	return groups, all
+}
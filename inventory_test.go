@@ -0,0 +1,37 @@
+package dbot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandHostPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		want    []string
+		ok      bool
+	}{
+		{"web", []string{"web"}, true},
+		{"web[1:3]", []string{"web1", "web2", "web3"}, true},
+		{"web[01:03].example.com", []string{
+			"web01.example.com", "web02.example.com", "web03.example.com",
+		}, true},
+		{"db-[a:c]", []string{"db-a", "db-b", "db-c"}, true},
+		{"n[1:9:4]", []string{"n1", "n5", "n9"}, true},
+		{"r[1:2]-[a:b]", []string{"r1-a", "r1-b", "r2-a", "r2-b"}, true},
+		{"web[3:1]", nil, false},
+		{"web[1:3:0]", nil, false},
+		{"web[c:a]", nil, false},
+		{"web[1:", nil, false},
+	}
+
+	for _, it := range testCases {
+		got, e := ExpandHostPattern(it.pattern)
+		if (e == nil) != it.ok || !reflect.DeepEqual(got, it.want) {
+			t.Errorf(
+				"ExpandHostPattern(%q) = %v, %v, want %v",
+				it.pattern, got, e, it.want,
+			)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package dbot
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// KubernetesRunner runs the commands in a kubernetes pod with
+// "kubectl exec"
+type KubernetesRunner struct {
+	kubectl   string
+	context   string
+	namespace string
+	pod       string
+	container string
+
+	sync.Mutex
+}
+
+// kubectlArgs returns the arguments of kubectl with the global flags
+func kubectlArgs(context string, args ...string) []string {
+	if context != "" {
+		return append([]string{"--context", context}, args...)
+	}
+
+	return args
+}
+
+// FindKubernetesPods returns the names of the running pods in namespace
+// that match the label selector
+func FindKubernetesPods(
+	kubectl string, context string, namespace string, selector string,
+) ([]string, error) {
+	args := []string{
+		"get", "pods",
+		"-n", namespace,
+		"--field-selector", "status.phase=Running",
+		"-o", "jsonpath={range .items[*]}{.metadata.name}{\"\\n\"}{end}",
+	}
+
+	if selector != "" {
+		args = append(args, "-l", selector)
+	}
+
+	stdout := &strings.Builder{}
+	if e := RunExecCommand(
+		exec.Command(kubectl, kubectlArgs(context, args...)...), nil, stdout,
+	); e != nil {
+		return nil, e
+	}
+
+	ret := make([]string, 0)
+	for _, name := range strings.Split(stdout.String(), "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret, nil
+}
+
+// NewKubernetesRunner creates a KubernetesRunner. kubectl is the path of
+// the kubectl binary, context is the kubeconfig context, and container is
+// the container in the pod, context and container can be empty.
+func NewKubernetesRunner(
+	kubectl string,
+	context string,
+	namespace string,
+	pod string,
+	container string,
+) *KubernetesRunner {
+	return &KubernetesRunner{
+		kubectl:   kubectl,
+		context:   context,
+		namespace: namespace,
+		pod:       pod,
+		container: container,
+	}
+}
+
+func (p *KubernetesRunner) Name() string {
+	if p.container != "" {
+		return fmt.Sprintf("pod:%s/%s/%s", p.namespace, p.pod, p.container)
+	}
+
+	return fmt.Sprintf("pod:%s/%s", p.namespace, p.pod)
+}
+
+// execArgs returns the arguments of kubectl to run script in the pod
+func (p *KubernetesRunner) execArgs(tty bool, script string) []string {
+	args := []string{"exec", "-i"}
+
+	if tty {
+		args = append(args, "-t")
+	}
+
+	args = append(args, "-n", p.namespace, p.pod)
+
+	if p.container != "" {
+		args = append(args, "-c", p.container)
+	}
+
+	return kubectlArgs(
+		p.context, append(args, "--", "/bin/sh", "-c", script)...,
+	)
+}
+
+func (p *KubernetesRunner) Run(ctx *Context) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if strings.TrimSpace(ctx.runCmd.Exec) == "" {
+		ctx.LogError("the command is empty")
+		return false
+	}
+
+	// kubectl exec could not set the environment, so set TERM in the script
+	script := ctx.runCmd.ShellScript()
+	if ctx.runCmd.Tty {
+		script = "TERM=" + ShellQuote(ctx.runCmd.TtyTerm) + " " + script
+	}
+
+	execCommand := exec.Command(
+		p.kubectl, p.execArgs(ctx.runCmd.Tty, script)...,
+	)
+	execCommand.Env = os.Environ()
+
+	return ExecRunnerCommand(ctx, execCommand)
+}
+
+func (p *KubernetesRunner) OpenFS(ctx *Context) RunnerFS {
+	return NewExecFS(func(script string, stdin io.Reader, stdout io.Writer) error {
+		return RunExecCommand(
+			exec.Command(p.kubectl, p.execArgs(false, script)...),
+			stdin,
+			stdout,
+		)
+	})
+}
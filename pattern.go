@@ -0,0 +1,170 @@
+package dbot
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// splitRunnerPattern splits the pattern into terms by "," and ":". The
+// colons in the names of the groups and the runners, such as "docker:web",
+// and the ports, such as "root@host:22", are kept.
+func (p *Context) splitRunnerPattern(pattern string) []string {
+	ret := make([]string, 0)
+
+	for _, part := range strings.Split(pattern, ",") {
+		tokens := strings.Split(part, ":")
+
+		for i := 0; i < len(tokens); i++ {
+			// Join the tokens to the longest name
+			term := tokens[i]
+			for j := len(tokens) - 1; j > i; j-- {
+				joined := strings.Join(tokens[i:j+1], ":")
+				name := strings.TrimLeft(strings.TrimSpace(joined), "&!")
+				if p.isRunnerTerm(strings.TrimSpace(name)) {
+					term = joined
+					i = j
+					break
+				}
+			}
+
+			// The port of the runner name
+			for i+1 < len(tokens) && isDigits(tokens[i+1]) {
+				term += ":" + tokens[i+1]
+				i++
+			}
+
+			if term = strings.TrimSpace(term); term != "" {
+				ret = append(ret, term)
+			}
+		}
+	}
+
+	return ret
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+func (p *Context) isRunnerTerm(name string) bool {
+	if _, ok := p.runnerGroupMap[name]; ok {
+		return true
+	}
+
+	_, ok := p.runnerMap[name]
+	return ok
+}
+
+// matchRunnerTerm returns the names of the runners matched by the term.
+// The term can be a group name, a runner name, a host name, or a glob
+// pattern of the runner names and the host names.
+func (p *Context) matchRunnerTerm(term string) ([]string, bool) {
+	if ret, ok := p.runnerGroupMap[term]; ok {
+		return ret, true
+	}
+
+	if _, ok := p.runnerMap[term]; ok {
+		return []string{term}, true
+	}
+
+	isGlob := strings.ContainsAny(term, "*?[")
+	if isGlob {
+		if _, e := filepath.Match(term, ""); e != nil {
+			p.LogError("pattern \"%s\" is invalid", term)
+			return nil, false
+		}
+	}
+
+	names := make([]string, 0, len(p.runnerMap))
+	for name := range p.runnerMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := make([]string, 0)
+	for _, name := range names {
+		host := runnerInfo(p.runnerMap[name])["host"]
+
+		if isGlob {
+			matchName, _ := filepath.Match(term, name)
+			matchHost, _ := filepath.Match(term, host)
+			if matchName || matchHost {
+				ret = append(ret, name)
+			}
+		} else if host == term {
+			ret = append(ret, name)
+		}
+	}
+
+	if len(ret) == 0 && !isGlob {
+		p.LogError("could not find group or host \"%s\"", term)
+		return nil, false
+	}
+
+	return ret, true
+}
+
+// selectRunners returns the names of the runners selected by the pattern.
+// The terms are separated by "," or ":", the runners of the terms are
+// merged, the terms with the prefix "&" intersect the result, and the terms
+// with the prefix "!" are excluded from the result. For example,
+// "web:&prod:!web03" selects the runners in both web and prod except web03.
+func (p *Context) selectRunners(pattern string) ([]string, bool) {
+	ret := make([]string, 0)
+	exists := make(map[string]bool)
+	intersects := make([]map[string]bool, 0)
+	excludes := make(map[string]bool)
+
+	for _, term := range p.splitRunnerPattern(pattern) {
+		kind := term[0]
+		if kind == '&' || kind == '!' {
+			term = strings.TrimSpace(term[1:])
+		}
+
+		names, ok := p.matchRunnerTerm(term)
+		if !ok {
+			return nil, false
+		}
+
+		switch kind {
+		case '&':
+			set := make(map[string]bool)
+			for _, name := range names {
+				set[name] = true
+			}
+			intersects = append(intersects, set)
+		case '!':
+			for _, name := range names {
+				excludes[name] = true
+			}
+		default:
+			for _, name := range names {
+				if !exists[name] {
+					exists[name] = true
+					ret = append(ret, name)
+				}
+			}
+		}
+	}
+
+	filtered := make([]string, 0, len(ret))
+	for _, name := range ret {
+		ok := !excludes[name]
+		for _, set := range intersects {
+			ok = ok && set[name]
+		}
+
+		if ok {
+			filtered = append(filtered, name)
+		}
+	}
+
+	return filtered, true
+}
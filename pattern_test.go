@@ -0,0 +1,75 @@
+package dbot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testPatternContext() *Context {
+	runners := []Runner{
+		&LocalRunner{},
+		NewSSHRunner(nil, "22", "root", "web01"),
+		NewSSHRunner(nil, "22", "root", "web02"),
+		NewSSHRunner(nil, "22", "root", "web03"),
+		NewSSHRunner(nil, "2222", "root", "db01"),
+		&DockerRunner{docker: "docker", container: "a"},
+	}
+
+	runnerMap := map[string]Runner{"local": runners[0]}
+	for _, runner := range runners[1:] {
+		runnerMap[runner.Name()] = runner
+	}
+
+	return &Context{
+		runnerGroupMap: map[string][]string{
+			"local": {"local"},
+			"web": {
+				"root@web01:22", "root@web02:22", "root@web03:22",
+			},
+			"prod":     {"root@web01:22", "root@db01:2222"},
+			"docker:a": {"docker:a"},
+		},
+		runnerMap: runnerMap,
+		options:   &Options{},
+	}
+}
+
+func TestSelectRunners(t *testing.T) {
+	ctx := testPatternContext()
+
+	testCases := []struct {
+		pattern string
+		want    []string
+		ok      bool
+	}{
+		{"web", []string{
+			"root@web01:22", "root@web02:22", "root@web03:22",
+		}, true},
+		{"web,prod", []string{
+			"root@web01:22", "root@web02:22", "root@web03:22",
+			"root@db01:2222",
+		}, true},
+		{"web:&prod", []string{"root@web01:22"}, true},
+		{"web:!web03", []string{"root@web01:22", "root@web02:22"}, true},
+		{"prod:!root@db01:2222", []string{"root@web01:22"}, true},
+		{"web, docker:a", []string{
+			"root@web01:22", "root@web02:22", "root@web03:22", "docker:a",
+		}, true},
+		{"local, &local", []string{"local"}, true},
+		{"web0[12]", []string{"root@web01:22", "root@web02:22"}, true},
+		{"db*", []string{"root@db01:2222"}, true},
+		{"nothing*", []string{}, true},
+		{"unknown", nil, false},
+		{"web[", nil, false},
+	}
+
+	for _, it := range testCases {
+		got, ok := ctx.selectRunners(it.pattern)
+		if ok != it.ok || !reflect.DeepEqual(got, it.want) {
+			t.Errorf(
+				"selectRunners(%q) = %v, %v, want %v, %v",
+				it.pattern, got, ok, it.want, it.ok,
+			)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package dbot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RunnerFactory creates a Runner from the config of a remote. The config
+// values are already parsed with the Env. If it fails, the error is logged
+// to ctx and nil is returned. The runners report the results of the
+// commands with ExecRunnerCommand or ReportRunnerResult, and can implement
+// RunnerInfo.
+type RunnerFactory func(ctx *Context, config map[string]string) Runner
+
+var (
+	gRunnerFactoryMap  = map[string]RunnerFactory{}
+	gRunnerFactoryLock = sync.Mutex{}
+)
+
+func init() {
+	_ = RegisterRunner("local", newLocalRunnerFromConfig)
+	_ = RegisterRunner("ssh", newSSHRunnerFromConfig)
+	_ = RegisterRunner("docker", newDockerRunnerFromConfig)
+}
+
+// RegisterRunner registers the runner type name, so that the remotes in the
+// config files can use it by "type: name"
+func RegisterRunner(name string, factory RunnerFactory) error {
+	gRunnerFactoryLock.Lock()
+	defer gRunnerFactoryLock.Unlock()
+
+	if name = strings.TrimSpace(name); name == "" {
+		return fmt.Errorf("runner type is empty")
+	} else if factory == nil {
+		return fmt.Errorf("runner factory of \"%s\" is nil", name)
+	} else if _, ok := gRunnerFactoryMap[name]; ok {
+		return fmt.Errorf("runner type \"%s\" is already registered", name)
+	}
+
+	gRunnerFactoryMap[name] = factory
+	return nil
+}
+
+func getRunnerFactory(name string) (RunnerFactory, bool) {
+	gRunnerFactoryLock.Lock()
+	defer gRunnerFactoryLock.Unlock()
+	ret, ok := gRunnerFactoryMap[name]
+	return ret, ok
+}
+
+func newLocalRunnerFromConfig(ctx *Context, _ map[string]string) Runner {
+	if runner, ok := ctx.runnerMap["local"]; ok {
+		return runner
+	}
+
+	return &LocalRunner{}
+}
+
+func newSSHRunnerFromConfig(ctx *Context, config map[string]string) Runner {
+	host := config["host"]
+	user := config["user"]
+	port := config["port"]
+
+	// Do not connect again if the runner already exists
+	id := fmt.Sprintf("%s@%s:%s", user, host, port)
+	if runner, ok := ctx.runnerMap[id]; ok {
+		return runner
+	}
+
+	if ret := NewSSHRunner(ctx, port, user, host); ret != nil {
+		return ret
+	}
+
+	return nil
+}
+
+func newDockerRunnerFromConfig(
+	ctx *Context, config map[string]string,
+) Runner {
+	name := config["name"]
+	if name == "" {
+		ctx.LogError("name is empty")
+		return nil
+	}
+
+	if runner, ok := ctx.runnerMap["docker:"+name]; ok {
+		return runner
+	}
+
+	docker := config["docker"]
+	if docker == "" {
+		docker = "docker"
+	}
+
+	if ret := NewDockerRunner(ctx, docker, name, config["user"]); ret != nil {
+		return ret
+	}
+
+	return nil
+}
+
+var (
+	gActionMap  = map[string]Action{}
+	gActionLock = sync.Mutex{}
+)
+
+// RegisterAction registers the tag, so that the commands in the config
+// files can use it by "tag: name"
+func RegisterAction(tag string, action Action) error {
+	gActionLock.Lock()
+	defer gActionLock.Unlock()
+
+	if tag = strings.TrimSpace(tag); tag == "" {
+		return fmt.Errorf("tag is empty")
+	} else if action == nil {
+		return fmt.Errorf("action of tag \"%s\" is nil", tag)
+	} else if _, ok := gActionMap[tag]; ok ||
+		tag == "job" || tag == flushHandlersTag {
+		return fmt.Errorf("tag \"%s\" is already registered", tag)
+	}
+
+	gActionMap[tag] = action
+	return nil
+}
+
+func getAction(tag string) (Action, bool) {
+	gActionLock.Lock()
+	defer gActionLock.Unlock()
+	ret, ok := gActionMap[tag]
+	return ret, ok
+}
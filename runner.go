@@ -5,55 +5,101 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/creack/pty"
+	"github.com/fatih/color"
 	"golang.org/x/crypto/ssh"
 )
 
-var outFilter = []string{
-	"\033",
-}
-
-var errFilter = []string{
-	"Output is not to a terminal",
-	"Input is not from a terminal",
-}
+// ReportRunnerResult logs the output of the command that has run on the
+// runner, and applies filter, register, changed_when and failed_when. e is
+// the error of the command. The registered runners that do not run local
+// processes can use it to report their results.
+func ReportRunnerResult(
+	ctx *Context, e error, out *bytes.Buffer, err *bytes.Buffer,
+) (canContinue bool) {
+	if ctx.guard != nil {
+		ctx.guard.done = true
+		ctx.guard.stdout = out.String()
+		ctx.guard.err = e
+		return e == nil
+	}
 
-func filterString(str string, filter []string) bool {
-	for _, v := range filter {
-		if strings.Contains(str, v) {
-			return true
+	// Keep the colour sequences only if our own output supports them
+	keepColor := !color.NoColor
+	filter := ctx.runCmd.Filter
+	secrets := ctx.runCmd.Secrets()
+	if ctx.runCmd.IsBecome() {
+		filter = append([]string{
+			regexp.QuoteMeta(BecomeMarker),
+			ctx.runCmd.BecomePrompt().String(),
+		}, filter...)
+
+		if v := ctx.getRunnerData().getBecomePassword(); v != "" {
+			secrets = append(secrets, v)
 		}
 	}
+	outString := MaskSecrets(
+		FilterLines(StripANSI(out.String(), keepColor), filter), secrets,
+	)
+	errString := MaskSecrets(
+		FilterLines(StripANSI(err.String(), keepColor), filter), secrets,
+	)
 
-	return false
-}
+	ctx.Log(outString, errString)
 
-func reportRunnerResult(
-	ctx *Context, e error, out *bytes.Buffer, err *bytes.Buffer,
-) (canContinue bool) {
-	outString := ""
-	errString := ""
-	if s := out.String(); !filterString(s, outFilter) {
-		outString += s
+	// The registered result may be saved to the cache, so the secrets are
+	// masked too
+	if name := ctx.runCmd.Register; name != "" {
+		ctx.getRunnerData().SetResult(name, strings.TrimSpace(MaskSecrets(
+			FilterLines(StripANSI(out.String(), false), filter), secrets,
+		)))
 	}
 
-	if s := err.String(); !filterString(s, errFilter) {
-		errString += s
-	}
+	// Decide the status by the conditions and the exit code
+	stdout := StripANSI(out.String(), false)
+	stderr := StripANSI(err.String(), false)
+	rc := exitCode(e)
+	failed := e != nil
+	if ctx.runCmd.FailedWhen != "" && rc >= 0 {
+		v, evalErr := evalCondition(ctx.runCmd.FailedWhen, stdout, stderr, rc)
+		if evalErr != nil {
+			ctx.LogError("failed_when: %s", evalErr.Error())
+			return false
+		}
 
-	ctx.Log(outString, errString)
+		if failed = v; failed && e == nil {
+			e = fmt.Errorf("failed_when is true")
+		}
+	}
 
-	if e != nil {
+	if failed {
 		ctx.LogError(e.Error())
 		return false
 	}
 
+	changed := true
+	if ctx.runCmd.ChangedWhen != "" {
+		v, evalErr := evalCondition(ctx.runCmd.ChangedWhen, stdout, stderr, rc)
+		if evalErr != nil {
+			ctx.LogError("changed_when: %s", evalErr.Error())
+			return false
+		}
+		changed = v
+	}
+
+	if changed {
+		ctx.SetStatus(StatusChanged)
+	}
+
 	return true
 }
 
@@ -67,8 +113,13 @@ type RunnerInput struct {
 }
 
 func NewRunnerInput(inputs []string, stdin io.Reader) *RunnerInput {
+	delay := time.Duration(0)
+	if len(inputs) > 0 {
+		delay = time.Second
+	}
+
 	return &RunnerInput{
-		delay:  time.Second,
+		delay:  delay,
 		reader: nil,
 		inputs: inputs,
 		stdin:  stdin,
@@ -106,9 +157,391 @@ func (p *RunnerInput) Read(b []byte) (n int, err error) {
 	}
 }
 
+// ExpectBecome answers the password prompt of the privilege escalation.
+// Password is called with retry set to true if the previous password was
+// rejected.
+type ExpectBecome struct {
+	Prompt   *regexp.Regexp
+	Password func(retry bool) (string, bool)
+}
+
+// Expecter provides the input of a command. It waits for the privilege
+// escalation if become is set, then writes the inputs, then writes the
+// response of each Expect once its pattern has been seen on the output.
+// The expects are handled in order.
+type Expecter struct {
+	inputs  []string
+	expects []*Expect
+	become  *ExpectBecome
+	output  string
+	closed  bool
+	err     error
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	onFail  func()
+	doneCH  chan bool
+	cond    *sync.Cond
+
+	sync.Mutex
+}
+
+// NewExpecter creates an Expecter and starts to handle the input.
+// onFail is called to stop the command if an expect fails.
+func NewExpecter(
+	inputs []string,
+	expects []*Expect,
+	become *ExpectBecome,
+	onFail func(),
+) *Expecter {
+	reader, writer := io.Pipe()
+	ret := &Expecter{
+		inputs:  inputs,
+		expects: expects,
+		become:  become,
+		reader:  reader,
+		writer:  writer,
+		onFail:  onFail,
+		doneCH:  make(chan bool),
+	}
+	ret.cond = sync.NewCond(ret)
+
+	go ret.run()
+
+	return ret
+}
+
+func (p *Expecter) run() {
+	defer close(p.doneCH)
+
+	fnFail := func(e error) {
+		p.Lock()
+		p.err = e
+		p.Unlock()
+		_ = p.writer.CloseWithError(e)
+		if p.onFail != nil {
+			p.onFail()
+		}
+	}
+
+	if p.become != nil {
+		if e := p.waitBecome(); e != nil {
+			fnFail(e)
+			return
+		}
+	}
+
+	if _, e := io.Copy(p.writer, NewRunnerInput(p.inputs, nil)); e != nil {
+		return
+	}
+
+	for _, it := range p.expects {
+		if e := p.wait(it); e != nil {
+			fnFail(e)
+			return
+		}
+
+		if _, e := p.writer.Write([]byte(it.Send)); e != nil {
+			return
+		}
+	}
+
+	_ = p.writer.Close()
+}
+
+func (p *Expecter) waitBecome() error {
+	timeout := 30 * time.Second
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		p.Lock()
+		defer p.Unlock()
+		p.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	p.Lock()
+	defer p.Unlock()
+
+	for retry := false; ; {
+		text := StripANSI(p.output, false)
+		if idx := strings.Index(text, BecomeMarker); idx >= 0 {
+			p.output = text[idx+len(BecomeMarker):]
+			return nil
+		}
+
+		if loc := p.become.Prompt.FindStringIndex(text); loc != nil {
+			p.output = text[loc[1]:]
+
+			// Do not hold the lock while waiting for the password
+			p.Unlock()
+			password, ok := p.become.Password(retry)
+			if ok {
+				_, _ = p.writer.Write([]byte(password + "\n"))
+			}
+			p.Lock()
+
+			if !ok {
+				return fmt.Errorf("incorrect become password")
+			}
+
+			retry = true
+			deadline = time.Now().Add(timeout)
+			timer.Reset(timeout)
+			continue
+		}
+
+		if p.closed {
+			return fmt.Errorf("privilege escalation failed")
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("privilege escalation timed out after %s", timeout)
+		}
+
+		p.cond.Wait()
+	}
+}
+
+func (p *Expecter) wait(expect *Expect) error {
+	// The pattern and timeout have been checked in subContext
+	pattern := regexp.MustCompile(expect.Pattern)
+	timeout, _ := time.ParseDuration(expect.Timeout)
+	deadline := time.Now().Add(timeout)
+
+	timer := time.AfterFunc(timeout, func() {
+		p.Lock()
+		defer p.Unlock()
+		p.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	p.Lock()
+	defer p.Unlock()
+
+	for {
+		text := StripANSI(p.output, false)
+		if loc := pattern.FindStringIndex(text); loc != nil {
+			p.output = text[loc[1]:]
+			return nil
+		}
+
+		if p.closed {
+			return fmt.Errorf("expect \"%s\" was not matched", expect.Pattern)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"expect \"%s\" timed out after %s", expect.Pattern, timeout,
+			)
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// Write receives the output of the command
+func (p *Expecter) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.closed && p.err == nil {
+		p.output += string(b)
+		p.cond.Broadcast()
+	}
+
+	return len(b), nil
+}
+
+// Read provides the responses to the command input
+func (p *Expecter) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// Close stops the Expecter after the command has finished, and returns
+// the error if any expect was not satisfied
+func (p *Expecter) Close() error {
+	p.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.Unlock()
+
+	// The command has finished, so no one reads the input any more
+	_ = p.reader.Close()
+	<-p.doneCH
+
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
+var gRunnerDataLock sync.Mutex
+
+// RunnerData keeps the data of a runner during the run, such as the
+// registered results
+type RunnerData struct {
+	results        Env
+	resultsTime    time.Time
+	facts          Env
+	factsTime      time.Time
+	steps          []*StepResult
+	becomePassword string
+	becomeLock     sync.Mutex
+	factsLock      sync.Mutex
+
+	sync.Mutex
+}
+
+// NewRunnerData creates a RunnerData
+func NewRunnerData() *RunnerData {
+	return &RunnerData{
+		results: Env{},
+		facts:   Env{},
+	}
+}
+
+// AddStep records the result of a command on the runner
+func (p *RunnerData) AddStep(step *StepResult) {
+	p.Lock()
+	defer p.Unlock()
+	p.steps = append(p.steps, step)
+}
+
+// HasFailed reports whether a command has failed on the runner, or the
+// runner has been unreachable
+func (p *RunnerData) HasFailed() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, step := range p.steps {
+		if step.Status == StatusFailed || step.Status == StatusUnreachable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetSteps returns the results of the commands on the runner
+func (p *RunnerData) GetSteps() []*StepResult {
+	p.Lock()
+	defer p.Unlock()
+	return append([]*StepResult{}, p.steps...)
+}
+
+// SetResult saves the result with name
+func (p *RunnerData) SetResult(name string, value string) {
+	p.Lock()
+	defer p.Unlock()
+	p.results[name] = value
+	p.resultsTime = time.Now()
+}
+
+// GetResults returns a copy of the registered results
+func (p *RunnerData) GetResults() Env {
+	p.Lock()
+	defer p.Unlock()
+	return p.results.Merge(nil)
+}
+
+// GetBecomePassword returns the become password of the runner. The user
+// is asked for it if it is unknown or retry is true.
+func (p *RunnerData) GetBecomePassword(
+	ctx *Context, retry bool,
+) (string, bool) {
+	p.becomeLock.Lock()
+	defer p.becomeLock.Unlock()
+
+	if v := p.getBecomePassword(); v != "" && !retry {
+		return v, true
+	}
+
+	desc := fmt.Sprintf(
+		"[become] password for %s on %s: ",
+		ctx.runCmd.BecomeUser, ctx.runners[0].Name(),
+	)
+	ret, ok := ctx.GetUserInput(desc, "password")
+	if ok {
+		p.Lock()
+		p.becomePassword = ret
+		p.Unlock()
+	}
+
+	return ret, ok
+}
+
+func (p *RunnerData) getBecomePassword() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.becomePassword
+}
+
+// SetFacts replaces the facts of the runner
+func (p *RunnerData) SetFacts(facts Env) {
+	p.Lock()
+	defer p.Unlock()
+	p.facts = facts.Merge(nil)
+	p.factsTime = time.Now()
+}
+
+// GetFacts returns a copy of the facts
+func (p *RunnerData) GetFacts() Env {
+	p.Lock()
+	defer p.Unlock()
+	return p.facts.Merge(nil)
+}
+
 type Runner interface {
 	Name() string
 	Run(ctx *Context) bool
+	// OpenFS opens the file system of the runner. If it fails, the error is
+	// logged to ctx and nil is returned
+	OpenFS(ctx *Context) RunnerFS
+}
+
+// RunnerInfo can be implemented by the registered runners to provide the
+// information of the runner, such as "host", "user" and "port". They are
+// used by ${HostName}, ${HostUser}, ${HostPort} and the host patterns.
+type RunnerInfo interface {
+	Info() map[string]string
+}
+
+// runnerInfo returns the information of the runner, "host" is the host
+// name, the container or the pod that the runner runs on
+func runnerInfo(runner Runner) map[string]string {
+	ret := map[string]string{"name": runner.Name()}
+
+	switch v := runner.(type) {
+	case *LocalRunner:
+		ret["type"] = "local"
+		ret["host"] = "localhost"
+		ret["user"] = os.Getenv("USER")
+	case *SSHRunner:
+		ret["type"] = "ssh"
+		ret["host"] = v.host
+		ret["user"] = v.user
+		ret["port"] = v.port
+	case *DockerRunner:
+		ret["type"] = "docker"
+		ret["host"] = v.container
+		ret["container"] = v.container
+		ret["user"] = v.user
+	case *KubernetesRunner:
+		ret["type"] = "kubernetes"
+		ret["host"] = v.pod
+		ret["namespace"] = v.namespace
+		ret["pod"] = v.pod
+		ret["container"] = v.container
+	case RunnerInfo:
+		ret["type"] = "custom"
+		ret["host"] = runner.Name()
+		for key, value := range v.Info() {
+			ret[key] = value
+		}
+	default:
+		ret["type"] = "custom"
+		ret["host"] = v.Name()
+	}
+
+	return ret
 }
 
 type LocalRunner struct {
@@ -123,22 +556,119 @@ func (p *LocalRunner) Run(ctx *Context) bool {
 	p.Lock()
 	defer p.Unlock()
 
-	// Split command and check
-	cmdArray := SplitCommand(ctx.runCmd.Exec)
-	if len(cmdArray) == 1 {
+	// Check the command
+	if strings.TrimSpace(ctx.runCmd.Exec) == "" {
 		ctx.LogError("the command is empty")
 		return false
 	}
 
-	// Make exec command
+	// Make exec command, it runs with the shell
+	cmdArray := ctx.runCmd.ShellArgs()
+	if ctx.runCmd.IsBecome() {
+		// The Env and Cwd are set in the script, because they are reset by
+		// the privilege escalation
+		cmdArray = []string{"/bin/sh", "-c", ctx.runCmd.ShellScript()}
+	}
+	execCommand := exec.Command(cmdArray[0], cmdArray[1:]...)
+	execCommand.Dir = ctx.runCmd.Cwd
+	execCommand.Env = append(os.Environ(), ctx.runCmd.ExportEnv()...)
+
+	return ExecRunnerCommand(ctx, execCommand)
+}
+
+// ExecRunnerCommand runs the local process execCommand with the input and
+// output of ctx.runCmd, and reports the result. The stdin, expect, tty and
+// become of the command are handled, so the registered runners can run
+// ctx.Command().ShellScript() with it.
+func ExecRunnerCommand(ctx *Context, execCommand *exec.Cmd) bool {
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
-	execCommand := exec.Command(cmdArray[0], cmdArray[1:]...)
-	execCommand.Stdin = NewRunnerInput(ctx.runCmd.Stdin, nil)
+	expecter := NewExpecter(
+		ctx.runCmd.Stdin,
+		ctx.runCmd.Expect,
+		ctx.getExpectBecome(),
+		func() {
+			if execCommand.Process != nil {
+				_ = execCommand.Process.Kill()
+			}
+		},
+	)
+
+	var e error
+	if ctx.runCmd.Tty {
+		e = runWithTty(
+			ctx, execCommand, expecter, io.MultiWriter(stdout, expecter),
+		)
+	} else {
+		e = runWithPipe(
+			execCommand,
+			expecter,
+			io.MultiWriter(stdout, expecter),
+			io.MultiWriter(stderr, expecter),
+		)
+	}
+
+	if v := expecter.Close(); v != nil {
+		e = v
+	}
+
+	return ReportRunnerResult(ctx, e, stdout, stderr)
+}
+
+func runWithPipe(
+	execCommand *exec.Cmd, stdin io.Reader, stdout io.Writer, stderr io.Writer,
+) error {
 	execCommand.Stdout = stdout
 	execCommand.Stderr = stderr
 
-	return reportRunnerResult(ctx, execCommand.Run(), stdout, stderr)
+	// Copy the stdin by ourselves. Because the input may wait for the
+	// output, and exec.Cmd.Wait would wait for the input to finish
+	writer, e := execCommand.StdinPipe()
+	if e != nil {
+		return e
+	}
+
+	if e := execCommand.Start(); e != nil {
+		return e
+	}
+
+	go func() {
+		_, _ = io.Copy(writer, stdin)
+		_ = writer.Close()
+	}()
+
+	return execCommand.Wait()
+}
+
+func runWithTty(
+	ctx *Context, execCommand *exec.Cmd, stdin io.Reader, stdout io.Writer,
+) error {
+	width, height := ctx.runCmd.TtySize()
+	execCommand.Env = append(execCommand.Env, "TERM="+ctx.runCmd.TtyTerm)
+
+	ptmx, e := pty.StartWithSize(execCommand, &pty.Winsize{
+		Rows: uint16(height),
+		Cols: uint16(width),
+	})
+	if e != nil {
+		return e
+	}
+	defer func() {
+		_ = ptmx.Close()
+	}()
+
+	go func() {
+		_, _ = io.Copy(ptmx, stdin)
+	}()
+
+	// Reading from the pty returns an error when the command exits
+	_, _ = io.Copy(stdout, ptmx)
+
+	return execCommand.Wait()
+}
+
+func (p *LocalRunner) OpenFS(ctx *Context) RunnerFS {
+	return &LocalFS{}
 }
 
 type SSHRunner struct {
@@ -147,6 +677,7 @@ type SSHRunner struct {
 	host     string
 	password string
 	key      string
+	client   *ssh.Client
 
 	sync.Mutex
 }
@@ -157,35 +688,62 @@ func NewSSHRunner(
 	user string,
 	host string,
 ) *SSHRunner {
-	ret := &SSHRunner{
+	// The connection is created when the runner is used first, so that the
+	// hosts excluded by the limit are never contacted
+	return &SSHRunner{
 		port:     port,
 		user:     user,
 		host:     host,
 		password: "",
 	}
+}
+
+func (p *SSHRunner) Name() string {
+	return fmt.Sprintf("%s@%s:%s", p.user, p.host, p.port)
+}
+
+func (p *SSHRunner) OpenFS(ctx *Context) RunnerFS {
+	p.Lock()
+	client := p.connect(ctx)
+	p.Unlock()
 
-	// Check if ssh can connect
-	client := ret.getClient(ctx)
 	if client == nil {
+		ctx.SetStatus(StatusUnreachable)
+		return nil
+	}
+
+	ret, e := NewSSHFS(client)
+	if e != nil {
+		ctx.LogError(e.Error())
 		return nil
 	}
-	_ = client.Close()
 
 	return ret
 }
 
-func (p *SSHRunner) Name() string {
-	return fmt.Sprintf("%s@%s:%s", p.user, p.host, p.port)
+// connect returns the ssh connection, it reconnects if the connection has
+// been broken
+func (p *SSHRunner) connect(ctx *Context) *ssh.Client {
+	if p.client != nil {
+		_, _, e := p.client.SendRequest("keepalive@dbot", true, nil)
+		if e == nil {
+			return p.client
+		}
+		_ = p.client.Close()
+	}
+
+	p.client = p.getClient(ctx)
+	return p.client
 }
 
 func (p *SSHRunner) Run(ctx *Context) bool {
 	p.Lock()
 	defer p.Unlock()
 
-	if client := p.getClient(ctx); client == nil {
+	if client := p.connect(ctx); client == nil {
+		ctx.SetStatus(StatusUnreachable)
 		return false
 	} else if session, e := client.NewSession(); e != nil {
-		_ = client.Close()
 		ctx.LogError(e.Error())
 		return false
 	} else {
@@ -193,13 +751,51 @@ func (p *SSHRunner) Run(ctx *Context) bool {
 		stdout := &bytes.Buffer{}
 		stderr := &bytes.Buffer{}
 
-		session.Stdin = NewRunnerInput(ctx.runCmd.Stdin, nil)
-		session.Stdout = stdout
-		session.Stderr = stderr
-
-		return reportRunnerResult(
-			ctx, session.Run(ctx.runCmd.Exec), stdout, stderr,
+		expecter := NewExpecter(
+			ctx.runCmd.Stdin,
+			ctx.runCmd.Expect,
+			ctx.getExpectBecome(),
+			func() {
+				_ = session.Close()
+			},
 		)
+		session.Stdin = expecter
+		session.Stdout = io.MultiWriter(stdout, expecter)
+		session.Stderr = io.MultiWriter(stderr, expecter)
+
+		if ctx.runCmd.Tty {
+			width, height := ctx.runCmd.TtySize()
+			if e := session.RequestPty(
+				ctx.runCmd.TtyTerm, height, width, ssh.TerminalModes{
+					ssh.TTY_OP_ISPEED: 14400,
+					ssh.TTY_OP_OSPEED: 14400,
+				},
+			); e != nil {
+				_ = session.Close()
+				_ = expecter.Close()
+				ctx.LogError(e.Error())
+				return false
+			}
+		}
+
+		// Set the Env by the ssh session if the server accepts it, so that
+		// it is not on the command line. The privilege escalation resets
+		// the environment, so the script exports the Env in that case.
+		exportEnv := ctx.runCmd.IsBecome()
+		for _, v := range ctx.runCmd.ExportEnv() {
+			if exportEnv {
+				break
+			}
+			kv := strings.SplitN(v, "=", 2)
+			exportEnv = session.Setenv(kv[0], kv[1]) != nil
+		}
+
+		e := session.Run(ctx.runCmd.shellScript(exportEnv))
+		if v := expecter.Close(); v != nil {
+			e = v
+		}
+
+		return ReportRunnerResult(ctx, e, stdout, stderr)
 	}
 }
 
@@ -233,9 +829,16 @@ func (p *SSHRunner) getClient(ctx *Context) *ssh.Client {
 		}
 	}
 
+	// unreachable is set if the host can not be connected, the password
+	// is not asked in this case
+	unreachable := false
 	fnClient := func(c *Context, cfg *ssh.ClientConfig, log bool) *ssh.Client {
 		ret, e := ssh.Dial("tcp", fmt.Sprintf("%s:%s", p.host, p.port), cfg)
-		if e != nil {
+		if _, ok := e.(*net.OpError); ok {
+			unreachable = true
+			c.LogError(e.Error())
+			return nil
+		} else if e != nil {
 			if log {
 				c.LogError(e.Error())
 			}
@@ -263,13 +866,26 @@ func (p *SSHRunner) getClient(ctx *Context) *ssh.Client {
 			}
 
 			config := fnParseKeyConfig(ctx, fileBytes, false)
-			if ret := fnClient(ctx, config, false); ret != nil {
+			if config == nil {
+				continue
+			} else if ret := fnClient(ctx, config, false); ret != nil {
 				return ret
+			} else if unreachable {
+				return nil
 			}
 		}
 
 		// No password is set and there is no valid ssh key.
-		// So we need to enter the password.
+		// So we need to enter the password if the host is reachable.
+		if conn, e := net.Dial(
+			"tcp", net.JoinHostPort(p.host, p.port),
+		); e != nil {
+			ctx.LogError(e.Error())
+			return nil
+		} else {
+			_ = conn.Close()
+		}
+
 		desc := fmt.Sprintf(
 			"password for ssh -p %s %s@%s: ",
 			p.port, p.user, p.host,
@@ -0,0 +1,101 @@
+package dbot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// runExpecter writes the outputs of a command to expecter one by one, and
+// returns the input that expecter has written and the error of Close
+func runExpecter(expecter *Expecter, outputs []string) (string, error) {
+	inputCH := make(chan string)
+	go func() {
+		v, _ := ioutil.ReadAll(expecter)
+		inputCH <- string(v)
+	}()
+
+	for _, it := range outputs {
+		// Give the expecter time to answer the previous output
+		time.Sleep(50 * time.Millisecond)
+		_, _ = expecter.Write([]byte(it))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	e := expecter.Close()
+	return <-inputCH, e
+}
+
+func TestExpecter(t *testing.T) {
+	fnBecome := func(password string) *ExpectBecome {
+		return &ExpectBecome{
+			Prompt: regexp.MustCompile(regexp.QuoteMeta(BecomeSudoPrompt)),
+			Password: func(retry bool) (string, bool) {
+				return password, !retry
+			},
+		}
+	}
+	fnExpect := func(pattern string, send string) *Expect {
+		return &Expect{Pattern: pattern, Send: send, Timeout: "5s"}
+	}
+
+	testCases := []struct {
+		expects []*Expect
+		become  *ExpectBecome
+		outputs []string
+		input   string
+		err     error
+	}{
+		{nil, nil, []string{"hello\n"}, "", nil},
+		{
+			[]*Expect{fnExpect("Password:", "pw\n")}, nil,
+			[]string{"Password: "}, "pw\n", nil,
+		},
+		{
+			[]*Expect{fnExpect("user:", "u\n"), fnExpect("pass:", "p\n")}, nil,
+			[]string{"user: ", "pass: "}, "u\np\n", nil,
+		},
+		{
+			[]*Expect{fnExpect("Password:", "pw\n")}, nil,
+			[]string{"\x1b[1mPassword:\x1b[0m "}, "pw\n", nil,
+		},
+		{
+			[]*Expect{fnExpect("Password:", "pw\n")}, nil,
+			[]string{"other\n"}, "",
+			fmt.Errorf("expect \"Password:\" was not matched"),
+		},
+		{
+			[]*Expect{fnExpect("Password:", "pw\n")}, fnBecome("secret"),
+			[]string{BecomeSudoPrompt, BecomeMarker + "\n", "Password: "},
+			"secret\npw\n", nil,
+		},
+		{
+			nil, fnBecome("secret"),
+			[]string{BecomeMarker + "\n"}, "", nil,
+		},
+		{
+			nil, fnBecome("wrong"),
+			[]string{BecomeSudoPrompt, "Sorry\n" + BecomeSudoPrompt},
+			"wrong\n", fmt.Errorf("incorrect become password"),
+		},
+		{
+			nil, fnBecome("secret"),
+			[]string{"sudo: not allowed\n"}, "",
+			fmt.Errorf("privilege escalation failed"),
+		},
+	}
+
+	for idx, it := range testCases {
+		input, e := runExpecter(
+			NewExpecter(nil, it.expects, it.become, nil), it.outputs,
+		)
+		if input != it.input || fmt.Sprint(e) != fmt.Sprint(it.err) {
+			t.Errorf(
+				"case %d: input = %q, error = %v, want %q, %v",
+				idx, input, e, it.input, it.err,
+			)
+		}
+	}
+}
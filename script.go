@@ -54,6 +54,65 @@ func parseValueToStdin(path string, value otto.Value) ([]string, error) {
 	return ret, nil
 }
 
+func parseValueToExpect(path string, value otto.Value) ([]*Expect, error) {
+	ret := []*Expect{}
+
+	if !value.IsObject() {
+		return ret, fmt.Errorf("%s must be object", path)
+	}
+
+	for _, key := range value.Object().Keys() {
+		itemPath := fmt.Sprintf("%s[%s]", path, key)
+		if strconv.FormatInt(int64(len(ret)), 10) != key {
+			return ret, fmt.Errorf("%s must be array", path)
+		} else if item, e := value.Object().Get(key); e != nil {
+			return ret, fmt.Errorf("%s error: %s", itemPath, e.Error())
+		} else if !item.IsObject() {
+			return ret, fmt.Errorf("%s must be object", itemPath)
+		} else {
+			expect := &Expect{}
+			for _, name := range item.Object().Keys() {
+				v, e := item.Object().Get(name)
+				if e != nil {
+					return ret, fmt.Errorf(
+						"%s.%s error: %s", itemPath, name, e.Error(),
+					)
+				}
+
+				switch name {
+				case "pattern", "send", "timeout":
+					if !v.IsString() {
+						return ret, fmt.Errorf(
+							"%s.%s must be string", itemPath, name,
+						)
+					}
+					if name == "pattern" {
+						expect.Pattern = v.String()
+					} else if name == "send" {
+						expect.Send = v.String()
+					} else {
+						expect.Timeout = v.String()
+					}
+				case "secret":
+					if !v.IsBoolean() {
+						return ret, fmt.Errorf(
+							"%s.%s must be boolean", itemPath, name,
+						)
+					}
+					expect.Secret, _ = v.ToBoolean()
+				default:
+					return ret, fmt.Errorf(
+						"%s.%s is not supported", itemPath, name,
+					)
+				}
+			}
+			ret = append(ret, expect)
+		}
+	}
+
+	return ret, nil
+}
+
 func parseObjectToCommand(object *otto.Object) (*Command, error) {
 	ret := &Command{}
 	keys := object.Keys()
@@ -85,6 +144,156 @@ func parseObjectToCommand(object *otto.Object) (*Command, error) {
 				return nil, e
 			}
 			ret.Stdin = stdin
+		case "filter":
+			filter, e := parseValueToStdin("filter", value)
+			if e != nil {
+				return nil, e
+			}
+			ret.Filter = filter
+		case "expect":
+			expect, e := parseValueToExpect("expect", value)
+			if e != nil {
+				return nil, e
+			}
+			ret.Expect = expect
+		case "tty":
+			if !value.IsBoolean() {
+				return nil, fmt.Errorf("tty must be boolean")
+			}
+			ret.Tty, _ = value.ToBoolean()
+		case "tty_term":
+			if !value.IsString() {
+				return nil, fmt.Errorf("tty_term must be string")
+			}
+			ret.TtyTerm = value.String()
+		case "tty_width":
+			if !value.IsString() {
+				return nil, fmt.Errorf("tty_width must be string")
+			}
+			ret.TtyWidth = value.String()
+		case "tty_height":
+			if !value.IsString() {
+				return nil, fmt.Errorf("tty_height must be string")
+			}
+			ret.TtyHeight = value.String()
+		case "src":
+			if !value.IsString() {
+				return nil, fmt.Errorf("src must be string")
+			}
+			ret.Src = value.String()
+		case "dest":
+			if !value.IsString() {
+				return nil, fmt.Errorf("dest must be string")
+			}
+			ret.Dest = value.String()
+		case "content":
+			if !value.IsString() {
+				return nil, fmt.Errorf("content must be string")
+			}
+			ret.Content = value.String()
+		case "mode":
+			if !value.IsString() {
+				return nil, fmt.Errorf("mode must be string")
+			}
+			ret.Mode = value.String()
+		case "owner":
+			if !value.IsString() {
+				return nil, fmt.Errorf("owner must be string")
+			}
+			ret.Owner = value.String()
+		case "fail_on_missing":
+			if !value.IsBoolean() {
+				return nil, fmt.Errorf("fail_on_missing must be boolean")
+			}
+			ret.FailOnMissing, _ = value.ToBoolean()
+		case "register":
+			if !value.IsString() {
+				return nil, fmt.Errorf("register must be string")
+			}
+			ret.Register = value.String()
+		case "delete":
+			if !value.IsBoolean() {
+				return nil, fmt.Errorf("delete must be boolean")
+			}
+			ret.Delete, _ = value.ToBoolean()
+		case "exclude":
+			exclude, e := parseValueToStdin("exclude", value)
+			if e != nil {
+				return nil, e
+			}
+			ret.Exclude = exclude
+		case "compare":
+			if !value.IsString() {
+				return nil, fmt.Errorf("compare must be string")
+			}
+			ret.Compare = value.String()
+		case "shell":
+			if !value.IsString() {
+				return nil, fmt.Errorf("shell must be string")
+			}
+			ret.Shell = value.String()
+		case "cwd":
+			if !value.IsString() {
+				return nil, fmt.Errorf("cwd must be string")
+			}
+			ret.Cwd = value.String()
+		case "creates":
+			if !value.IsString() {
+				return nil, fmt.Errorf("creates must be string")
+			}
+			ret.Creates = value.String()
+		case "removes":
+			if !value.IsString() {
+				return nil, fmt.Errorf("removes must be string")
+			}
+			ret.Removes = value.String()
+		case "unless":
+			if !value.IsString() {
+				return nil, fmt.Errorf("unless must be string")
+			}
+			ret.Unless = value.String()
+		case "changed_when":
+			if !value.IsString() {
+				return nil, fmt.Errorf("changed_when must be string")
+			}
+			ret.ChangedWhen = value.String()
+		case "failed_when":
+			if !value.IsString() {
+				return nil, fmt.Errorf("failed_when must be string")
+			}
+			ret.FailedWhen = value.String()
+		case "notify":
+			notify, e := parseValueToStdin("notify", value)
+			if e != nil {
+				return nil, e
+			}
+			ret.Notify = notify
+		case "check_safe":
+			if !value.IsBoolean() {
+				return nil, fmt.Errorf("check_safe must be boolean")
+			}
+			ret.CheckSafe, _ = value.ToBoolean()
+		case "become":
+			if !value.IsBoolean() {
+				return nil, fmt.Errorf("become must be boolean")
+			}
+			become, _ := value.ToBoolean()
+			ret.Become = &become
+		case "become_user":
+			if !value.IsString() {
+				return nil, fmt.Errorf("become_user must be string")
+			}
+			ret.BecomeUser = value.String()
+		case "become_method":
+			if !value.IsString() {
+				return nil, fmt.Errorf("become_method must be string")
+			}
+			ret.BecomeMethod = value.String()
+		case "become_password":
+			if !value.IsString() {
+				return nil, fmt.Errorf("become_password must be string")
+			}
+			ret.BecomePassword = value.String()
 		case "env":
 			env, e := parseValueToEnv("env", value)
 			if e != nil {
@@ -97,6 +306,13 @@ func parseObjectToCommand(object *otto.Object) (*Command, error) {
 				return nil, e
 			}
 			ret.Args = args
+		case "params":
+			params, _ := value.Export()
+			if v, ok := params.(map[string]interface{}); ok {
+				ret.Params = v
+			} else {
+				return nil, fmt.Errorf("params must be object")
+			}
 		case "file":
 			if !value.IsString() {
 				return nil, fmt.Errorf("file must be string")
@@ -0,0 +1,225 @@
+package dbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// Status is the result of a command on a runner
+type Status string
+
+const (
+	StatusOK          Status = "ok"
+	StatusChanged     Status = "changed"
+	StatusSkipped     Status = "skipped"
+	StatusFailed      Status = "failed"
+	StatusUnreachable Status = "unreachable"
+)
+
+// StepResult is the result of a command on a runner
+type StepResult struct {
+	Runner string `json:"runner"`
+	Path   string `json:"path"`
+	Tag    string `json:"tag"`
+	Status Status `json:"status"`
+	// Duration is written to the report as "duration" in seconds
+	Duration time.Duration `json:"-"`
+	// Diff is the diff of the files changed by the command, it is set if
+	// the diff is enabled
+	Diff string `json:"diff,omitempty"`
+}
+
+// MarshalJSON encodes the result with the duration in seconds
+func (p StepResult) MarshalJSON() ([]byte, error) {
+	type stepResult StepResult
+	return json.Marshal(struct {
+		stepResult
+		Duration float64 `json:"duration"`
+	}{
+		stepResult: stepResult(p),
+		Duration:   p.Duration.Seconds(),
+	})
+}
+
+// SetStatus sets the status of the command that is running. The status is
+// "ok" by default, and it is "failed" if the command returns false and the
+// status is not "unreachable".
+func (p *Context) SetStatus(status Status) {
+	if p.step != nil {
+		p.step.Status = status
+	}
+}
+
+// addDiff appends the diff of a file to the result of the command
+func (p *Context) addDiff(diff string) {
+	if p.step != nil {
+		p.step.Diff += diff
+	}
+}
+
+// runStep runs the command on the runner, and records its status and
+// duration in the data of the runner
+func (p *Context) runStep(fn func() bool) bool {
+	start := time.Now()
+	step := &StepResult{
+		Runner: p.runners[0].Name(),
+		Path:   p.path,
+		Tag:    p.runCmd.Tag,
+		Status: StatusOK,
+	}
+	p.step = step
+
+	ret := fn()
+	if !ret && step.Status != StatusUnreachable {
+		step.Status = StatusFailed
+	}
+	step.Duration = time.Since(start)
+
+	if step.Status == StatusChanged {
+		p.notifyHandlers()
+	}
+
+	p.getRunnerData().AddStep(step)
+	return ret
+}
+
+// exitCode returns the exit code of the command error, it is -1 if the
+// command has not exited
+func exitCode(e error) int {
+	if e == nil {
+		return 0
+	}
+
+	if v, ok := e.(interface{ ExitStatus() int }); ok {
+		return v.ExitStatus()
+	} else if v, ok := e.(interface{ ExitCode() int }); ok {
+		return v.ExitCode()
+	} else if v, ok := e.(*ExecError); ok {
+		return v.Code
+	}
+
+	return -1
+}
+
+// evalCondition evaluates the JavaScript condition of changed_when and
+// failed_when. stdout, stderr and rc (the exit code) can be used in it.
+func evalCondition(
+	condition string, stdout string, stderr string, rc int,
+) (bool, error) {
+	vm := otto.New()
+	_ = vm.Set("stdout", stdout)
+	_ = vm.Set("stderr", stderr)
+	_ = vm.Set("rc", rc)
+
+	value, e := vm.Run(condition)
+	if e != nil {
+		return false, e
+	}
+
+	return value.ToBoolean()
+}
+
+// checkCondition checks the syntax of the condition
+func checkCondition(condition string) error {
+	_, e := otto.New().Compile("", condition)
+	return e
+}
+
+// HasFailed reports whether any command has failed, or any runner has been
+// unreachable during the run
+func (p *Context) HasFailed() bool {
+	for _, name := range p.runnerNames() {
+		if p.getRunnerDataByName(name).HasFailed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runnerNames returns the sorted names of the runners that have data
+func (p *Context) runnerNames() []string {
+	gRunnerDataLock.Lock()
+	defer gRunnerDataLock.Unlock()
+
+	ret := make([]string, 0, len(p.runnerDataMap))
+	for name := range p.runnerDataMap {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// saveReport writes the results of the commands on all the runners to the
+// file options.Report as JSON
+func (p *Context) saveReport() {
+	if p.options.Report == "" {
+		return
+	}
+
+	steps := make([]*StepResult, 0)
+	for _, name := range p.runnerNames() {
+		steps = append(steps, p.getRunnerDataByName(name).GetSteps()...)
+	}
+
+	if data, e := json.MarshalIndent(steps, "", "  "); e != nil {
+		p.LogError("could not save the report: %s", e.Error())
+	} else if e := ioutil.WriteFile(
+		p.options.Report, append(data, '\n'), 0644,
+	); e != nil {
+		p.LogError("could not save the report: %s", e.Error())
+	}
+}
+
+// logRecap prints the counts of the statuses and the total duration of
+// each runner
+func (p *Context) logRecap() {
+	names := p.runnerNames()
+
+	sb := &strings.Builder{}
+	w := tabwriter.NewWriter(sb, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(
+		w, "RUNNER\tOK\tCHANGED\tSKIPPED\tFAILED\tUNREACHABLE\tDURATION",
+	)
+
+	rows := 0
+	for _, name := range names {
+		steps := p.getRunnerDataByName(name).GetSteps()
+		if len(steps) == 0 {
+			continue
+		}
+
+		counts := make(map[Status]int)
+		duration := time.Duration(0)
+		for _, step := range steps {
+			counts[step.Status]++
+			duration += step.Duration
+		}
+
+		_, _ = fmt.Fprintf(
+			w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			name,
+			counts[StatusOK], counts[StatusChanged], counts[StatusSkipped],
+			counts[StatusFailed], counts[StatusUnreachable],
+			duration.Round(time.Millisecond),
+		)
+		rows++
+	}
+	_ = w.Flush()
+
+	title := "RECAP"
+	if p.CheckMode() {
+		title = "RECAP (check mode, no changes are applied)"
+	}
+
+	if rows > 0 {
+		p.logRawInfo("\n%s\n%s", title, sb.String())
+	}
+}